@@ -0,0 +1,225 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A sysClient issues the system calls needed by the operations on the
+// system under test. File descriptors are only meaningful to the client
+// that returned them. Paths passed to open, truncate, rename, chmod and
+// statfs and the extended attribute calls are rooted at the mount point of the
+// system under test.
+type sysClient interface {
+	open(path string, flags int, mode uint32) (int, error)
+	openat(dirfd int, path string, flags int, mode uint32) (int, error)
+	seek(fd int, offset int64, whence int) (int64, error)
+	read(fd int, p []byte) (int, error)
+	write(fd int, p []byte) (int, error)
+	close(fd int) error
+	dup(fd int) (int, error)
+	dup3(oldfd int, newfd int, flags int) error
+	fcntl(fd int, cmd int, arg int) (int, error)
+	pread(fd int, p []byte, offset int64) (int, error)
+	pwrite(fd int, p []byte, offset int64) (int, error)
+	readv(fd int, iovs [][]byte) (int, error)
+	writev(fd int, iovs [][]byte) (int, error)
+	getdents(fd int, buf []byte) (int, error)
+	fsync(fd int) error
+	fdatasync(fd int) error
+	syncfs(fd int) error
+	unlinkat(dirfd int, path string, flags int) error
+	mkdirat(dirfd int, path string, mode uint32) error
+	truncate(path string, length int64) error
+	ftruncate(fd int, length int64) error
+	fallocate(fd int, mode uint32, offset int64, length int64) error
+	rename(oldpath, newpath string) error
+	renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) error
+	symlinkat(target string, dirfd int, path string) error
+	readlinkat(dirfd int, path string, buf []byte) (int, error)
+	fstatat(dirfd int, path string, st *unix.Stat_t, flags int) error
+	linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error
+	chmod(path string, mode uint32) error
+	fchmod(fd int, mode uint32) error
+	fchmodat(dirfd int, path string, mode uint32) error
+	faccessat(dirfd int, path string, mode uint32) error
+	utimensat(dirfd int, path string, times []unix.Timespec, flags int) error
+	futimens(fd int, times []unix.Timespec) error
+	fstat(fd int, st *unix.Stat_t) error
+	statfs(path string, st *unix.Statfs_t) error
+	setxattr(path string, name string, value []byte, flags int) error
+	getxattr(path string, name string, value []byte) (int, error)
+	listxattr(path string, list []byte) (int, error)
+	removexattr(path string, name string) error
+}
+
+// Issues system calls through the kernel, as for the reference file system.
+type kernelClient struct{}
+
+func (kernelClient) open(path string, flags int, mode uint32) (int, error) {
+	return syscall.Open(path, flags, mode)
+}
+
+func (kernelClient) openat(dirfd int, path string, flags int, mode uint32) (int, error) {
+	return syscall.Openat(dirfd, path, flags, mode)
+}
+
+func (kernelClient) seek(fd int, offset int64, whence int) (int64, error) {
+	return syscall.Seek(fd, offset, whence)
+}
+
+func (kernelClient) read(fd int, p []byte) (int, error) {
+	return syscall.Read(fd, p)
+}
+
+func (kernelClient) write(fd int, p []byte) (int, error) {
+	return syscall.Write(fd, p)
+}
+
+func (kernelClient) close(fd int) error {
+	return syscall.Close(fd)
+}
+
+func (kernelClient) dup(fd int) (int, error) {
+	return unix.Dup(fd)
+}
+
+func (kernelClient) dup3(oldfd int, newfd int, flags int) error {
+	return unix.Dup3(oldfd, newfd, flags)
+}
+
+func (kernelClient) fcntl(fd int, cmd int, arg int) (int, error) {
+	return unix.FcntlInt(uintptr(fd), cmd, arg)
+}
+
+func (kernelClient) pread(fd int, p []byte, offset int64) (int, error) {
+	return unix.Pread(fd, p, offset)
+}
+
+func (kernelClient) pwrite(fd int, p []byte, offset int64) (int, error) {
+	return unix.Pwrite(fd, p, offset)
+}
+
+func (kernelClient) readv(fd int, iovs [][]byte) (int, error) {
+	return unix.Readv(fd, iovs)
+}
+
+func (kernelClient) writev(fd int, iovs [][]byte) (int, error) {
+	return unix.Writev(fd, iovs)
+}
+
+func (kernelClient) getdents(fd int, buf []byte) (int, error) {
+	return unix.Getdents(fd, buf)
+}
+
+func (kernelClient) fsync(fd int) error {
+	return unix.Fsync(fd)
+}
+
+func (kernelClient) fdatasync(fd int) error {
+	return unix.Fdatasync(fd)
+}
+
+func (kernelClient) syncfs(fd int) error {
+	return unix.Syncfs(fd)
+}
+
+func (kernelClient) unlinkat(dirfd int, path string, flags int) error {
+	return unix.Unlinkat(dirfd, path, flags)
+}
+
+func (kernelClient) mkdirat(dirfd int, path string, mode uint32) error {
+	return syscall.Mkdirat(dirfd, path, mode)
+}
+
+func (kernelClient) truncate(path string, length int64) error {
+	return syscall.Truncate(path, length)
+}
+
+func (kernelClient) ftruncate(fd int, length int64) error {
+	return syscall.Ftruncate(fd, length)
+}
+
+func (kernelClient) fallocate(fd int, mode uint32, offset int64, length int64) error {
+	return unix.Fallocate(fd, mode, offset, length)
+}
+
+func (kernelClient) rename(oldpath, newpath string) error {
+	return syscall.Rename(oldpath, newpath)
+}
+
+func (kernelClient) renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) error {
+	return unix.Renameat2(olddirfd, oldpath, newdirfd, newpath, flags)
+}
+
+func (kernelClient) symlinkat(target string, dirfd int, path string) error {
+	return unix.Symlinkat(target, dirfd, path)
+}
+
+func (kernelClient) readlinkat(dirfd int, path string, buf []byte) (int, error) {
+	return unix.Readlinkat(dirfd, path, buf)
+}
+
+func (kernelClient) fstatat(dirfd int, path string, st *unix.Stat_t, flags int) error {
+	return unix.Fstatat(dirfd, path, st, flags)
+}
+
+func (kernelClient) linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+	return unix.Linkat(olddirfd, oldpath, newdirfd, newpath, flags)
+}
+
+func (kernelClient) chmod(path string, mode uint32) error {
+	return syscall.Chmod(path, mode)
+}
+
+func (kernelClient) fchmod(fd int, mode uint32) error {
+	return syscall.Fchmod(fd, mode)
+}
+
+func (kernelClient) fchmodat(dirfd int, path string, mode uint32) error {
+	return unix.Fchmodat(dirfd, path, mode, 0)
+}
+
+func (kernelClient) faccessat(dirfd int, path string, mode uint32) error {
+	return unix.Faccessat(dirfd, path, mode, 0)
+}
+
+func (kernelClient) utimensat(dirfd int, path string, times []unix.Timespec, flags int) error {
+	return unix.UtimesNanoAt(dirfd, path, times, flags)
+}
+
+// Calls utimensat with a null path, as the C library does, as there's no
+// wrapper for futimens and AT_EMPTY_PATH is only supported since Linux 5.8.
+func (kernelClient) futimens(fd int, times []unix.Timespec) error {
+	_, _, e := unix.Syscall6(unix.SYS_UTIMENSAT, uintptr(fd), 0, uintptr(unsafe.Pointer(&times[0])), 0, 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func (kernelClient) fstat(fd int, st *unix.Stat_t) error {
+	return unix.Fstat(fd, st)
+}
+
+func (kernelClient) statfs(path string, st *unix.Statfs_t) error {
+	return unix.Statfs(path, st)
+}
+
+func (kernelClient) setxattr(path string, name string, value []byte, flags int) error {
+	return unix.Setxattr(path, name, value, flags)
+}
+
+func (kernelClient) getxattr(path string, name string, value []byte) (int, error) {
+	return unix.Getxattr(path, name, value)
+}
+
+func (kernelClient) listxattr(path string, list []byte) (int, error) {
+	return unix.Listxattr(path, list)
+}
+
+func (kernelClient) removexattr(path string, name string) error {
+	return unix.Removexattr(path, name)
+}
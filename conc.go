@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+// The most concurrent workers, as checking a round may mean trying all
+// orderings of its operations.
+const maxWorkers = 6
+
+// A concOp is an operation run by a worker concurrently with those of
+// other workers. Unlike an oper, it refers to files by pathname only, so
+// its outcome doesn't depend on the file descriptors of other workers.
+// Reads and writes open the file, read or write at the offset, and close
+// the file.
+type concOp struct {
+	worker      int
+	code        operKind
+	pathname    string
+	newpathname string
+	offset      int64
+	// Bytes to read, or length to truncate to.
+	size int
+	wbuf []byte
+
+	// The outcome on the system under test.
+	n   int
+	buf []byte
+	err error
+	// When the operation was started and when it returned.
+	start time.Time
+	end   time.Time
+}
+
+func (op *concOp) String() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "worker=%d code=%v pathname=%q", op.worker, op.code, op.pathname)
+	switch op.code {
+	case operRename1:
+		_, _ = fmt.Fprintf(&b, " newpathname=%q", op.newpathname)
+	case operTruncate:
+		_, _ = fmt.Fprintf(&b, " size=%d", op.size)
+	case operRead:
+		_, _ = fmt.Fprintf(&b, " offset=%d size=%d", op.offset, op.size)
+	case operWrite:
+		_, _ = fmt.Fprintf(&b, " offset=%d len=%d", op.offset, len(op.wbuf))
+	}
+	_, _ = fmt.Fprintf(&b, " n=%d err=%v", op.n, op.err)
+	return b.String()
+}
+
+// Reports whether workers can run operations of the given kind.
+func (code operKind) concurrent() bool {
+	switch code {
+	case operCreate, operMkdir, operRmdir, operUnlink1, operRename1, operTruncate, operRead, operWrite:
+		return true
+	default:
+		return false
+	}
+}
+
+func (seq *operSeq) nextConcOp(worker int) *concOp {
+again:
+	op := &concOp{worker: worker, code: seq.randomOperKind()}
+	switch op.code {
+	case operCreate:
+		// 5% existing directory, 25% existing file, 70% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(5, 25, 20)
+	case operMkdir:
+		// 20% existing directory, 10% existing file, 70% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(20, 10, 20)
+	case operRmdir:
+		// 65% existing directory, 15% existing file, 20% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(65, 15, 20)
+	case operUnlink1:
+		// 15% existing directory, 75% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(15, 75, 20)
+	case operRename1:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(30, 60, 20)
+		op.newpathname = filepath.Join(filepath.Dir(op.pathname), natoAlphabet[seq.rng.Intn(len(natoAlphabet))])
+	case operTruncate:
+		// 5% existing directory, 90% existing file, 5% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(5, 90, 20)
+		op.size = seq.rng.Intn(512)
+	case operRead:
+		op.pathname = seq.randomPathname(5, 90, 20)
+		op.offset = int64(seq.rng.Intn(512))
+		op.size = seq.rng.Intn(512)
+	case operWrite:
+		op.pathname = seq.randomPathname(5, 90, 20)
+		op.offset = int64(seq.rng.Intn(512))
+		op.wbuf = make([]byte, seq.rng.Intn(512))
+		seq.rng.Read(op.wbuf)
+	default:
+		goto again
+	}
+	return op
+}
+
+// Runs the operation through the client, on the file system mounted at
+// mnt, whose root directory is open as root.
+func (op *concOp) runOn(c sysClient, root int, mnt string) (n int, buf []byte, err error) {
+	switch op.code {
+	case operCreate:
+		fd, err := c.openat(root, op.pathname, createFlags, 0777)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, c.close(fd)
+	case operMkdir:
+		return 0, nil, c.mkdirat(root, op.pathname, 0777)
+	case operRmdir:
+		return 0, nil, c.unlinkat(root, op.pathname, unix.AT_REMOVEDIR)
+	case operUnlink1:
+		return 0, nil, c.unlinkat(root, op.pathname, 0)
+	case operRename1:
+		return 0, nil, c.rename(filepath.Join(mnt, op.pathname), filepath.Join(mnt, op.newpathname))
+	case operTruncate:
+		return 0, nil, c.truncate(filepath.Join(mnt, op.pathname), int64(op.size))
+	case operRead, operWrite:
+		flags := syscall.O_RDONLY
+		if op.code == operWrite {
+			flags = syscall.O_WRONLY
+		}
+		fd, err := c.openat(root, op.pathname, flags|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer func() {
+			if cerr := c.close(fd); err == nil {
+				err = cerr
+			}
+		}()
+		if _, err := c.seek(fd, op.offset, 0); err != nil {
+			return 0, nil, err
+		}
+		if op.code == operWrite {
+			n, err := c.write(fd, op.wbuf)
+			return n, nil, err
+		}
+		buf := make([]byte, op.size)
+		n, err := c.read(fd, buf)
+		if n > 0 {
+			buf = buf[:n]
+		} else {
+			buf = nil
+		}
+		return n, buf, err
+	default:
+		return 0, nil, fmt.Errorf("concOp.runOn: unsupported op code: %v", op.code)
+	}
+}
+
+// Runs the operations of a round on the system under test, each in its
+// own goroutine, all starting at once, and records their outcomes.
+func runRound(ops []*concOp, c sysClient, root int, mnt string) {
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, op := range ops {
+		wg.Add(1)
+		go func(op *concOp) {
+			defer wg.Done()
+			<-start
+			op.start = time.Now()
+			op.n, op.buf, op.err = op.runOn(c, root, mnt)
+			op.end = time.Now()
+		}(op)
+	}
+	close(start)
+	wg.Wait()
+}
+
+// Calls f with every ordering of the operations consistent with their
+// real-time order, i.e., an operation that returned before another
+// started comes first, until f returns true. Orderings closer to the
+// order the operations returned in are tried first. Returns whether f
+// returned true.
+func linearizations(ops []*concOp, f func([]*concOp) bool) bool {
+	sorted := make([]*concOp, len(ops))
+	copy(sorted, ops)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].end.Before(sorted[j].end)
+	})
+	placed := make([]bool, len(sorted))
+	order := make([]*concOp, 0, len(sorted))
+	var visit func() bool
+	visit = func() bool {
+		if len(order) == len(sorted) {
+			return f(order)
+		}
+	candidates:
+		for i, op := range sorted {
+			if placed[i] {
+				continue
+			}
+			for j, other := range sorted {
+				if !placed[j] && j != i && other.end.Before(op.start) {
+					continue candidates
+				}
+			}
+			placed[i] = true
+			order = append(order, op)
+			if visit() {
+				return true
+			}
+			order = order[:len(order)-1]
+			placed[i] = false
+		}
+		return false
+	}
+	return visit()
+}
+
+func sameOutcome(op *concOp, n int, buf []byte, err error) bool {
+	if (op.err == nil) != (err == nil) {
+		return false
+	}
+	if err != nil {
+		return op.err.Error() == err.Error()
+	}
+	return op.n == n && bytes.Equal(op.buf, buf)
+}
+
+// Looks for an ordering of the operations of a round that, replayed on
+// the reference file system, gives the same outcomes as on the system
+// under test, and the tree described by sutDesc. The reference file
+// system must be as before the round, a copy of which is at snapshot;
+// it's left as after the ordering found, if any.
+func linearize(ops []*concOp, snapshot string, sutDesc []byte) ([]*concOp, error) {
+	var found []*concOp
+	var failure error
+	tries := 0
+	linearizations(ops, func(order []*concOp) bool {
+		if tries > 0 {
+			if err := replaceTree(snapshot, refDir); err != nil {
+				failure = err
+				return true
+			}
+		}
+		tries++
+		root, err := syscall.Open(refDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			failure = err
+			return true
+		}
+		defer func() {
+			_ = syscall.Close(root)
+		}()
+		for _, op := range order {
+			n, buf, err := op.runOn(kernelClient{}, root, refDir)
+			if !sameOutcome(op, n, buf, err) {
+				logDebug("linearize: try %d: %v: ref n=%d err=%v", tries, op, n, err)
+				return false
+			}
+		}
+		refDesc, err := hashTree(refDir, true, true, false)
+		if err != nil {
+			failure = err
+			return true
+		}
+		if diff := cmp.Diff(sutDesc, refDesc); diff != "" {
+			logDebug("linearize: try %d: tree difference: %s", tries, diff)
+			return false
+		}
+		found = make([]*concOp, len(order))
+		copy(found, order)
+		return true
+	})
+	if failure != nil {
+		return nil, fmt.Errorf("linearize: %v", failure)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("linearize: none of %d orderings matches", tries)
+	}
+	return found, nil
+}
+
+// Main loop for concurrent operations: in each round, every worker runs
+// one operation on the system under test, and the round is checked to
+// be linearizable against the reference file system. Trees are always
+// compared in full, as they're needed to tell orderings apart.
+func runConcurrent(max int, workers int, seed int64, cfg *config) (err error) {
+	if workers > maxWorkers {
+		return fmt.Errorf("runConcurrent: at most %d workers supported", maxWorkers)
+	}
+	if err := cfg.restrict(filesystems); err != nil {
+		return fmt.Errorf("runConcurrent: %v", err)
+	}
+	if err := cfg.restrictConcurrent(); err != nil {
+		return fmt.Errorf("runConcurrent: %v", err)
+	}
+	seq := newOperSeq(max, cfg, seed)
+	logInfo("ranges: %v", seq.ranges)
+	defer func() {
+		if err != nil {
+			logWireTraceTail()
+		}
+	}()
+	sut := filesystems[suti]
+	c := sutClient()
+	root, err := c.open(sut.mountpoint(), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("runConcurrent: %v", err)
+	}
+	defer func() {
+		if err := c.close(root); err != nil {
+			logWarn("runConcurrent: %v", err)
+		}
+	}()
+	snapshot := filepath.Join(testDir, "round")
+	for round := 0; round*workers < max; round++ {
+		ops := make([]*concOp, workers)
+		for i := range ops {
+			ops[i] = seq.nextConcOp(i)
+		}
+		if err := replaceTree(refDir, snapshot); err != nil {
+			return fmt.Errorf("runConcurrent: %v", err)
+		}
+		runRound(ops, c, root, sut.mountpoint())
+		t0 := ops[0].start
+		for _, op := range ops {
+			if op.start.Before(t0) {
+				t0 = op.start
+			}
+		}
+		for _, op := range ops {
+			logInfo("runConcurrent: round=%d [%v, %v] %v", round, op.start.Sub(t0), op.end.Sub(t0), op)
+		}
+		sutDesc, err := hashSUT(sut, true, true, false)
+		if err != nil {
+			return fmt.Errorf("runConcurrent: %v", err)
+		}
+		order, err := linearize(ops, snapshot, sutDesc)
+		if err != nil {
+			return fmt.Errorf("runConcurrent: round %d: %w", round, err)
+		}
+		if len(order) > 1 {
+			workersOrder := make([]int, len(order))
+			for i, op := range order {
+				workersOrder[i] = op.worker
+			}
+			logDebug("runConcurrent: round=%d linearized as workers %v", round, workersOrder)
+		}
+		if err := seq.rescan(); err != nil {
+			return fmt.Errorf("runConcurrent: %v", err)
+		}
+	}
+	return nil
+}
@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // A random number falling between ranges[i-1].upperBound and
@@ -32,13 +36,121 @@ func (rs probabilityRanges) String() string {
 type config struct {
 	ProbabilitiesRaw map[string]int `json:"probabilities"`
 	probabilities    map[operKind]int
+
+	// Timestamps set explicitly must read back the same, truncated to
+	// this granularity, e.g., "1s" for 9P2000.u, which has no
+	// nanoseconds. Defaults to 1s.
+	TimeGranularityRaw string `json:"time_granularity"`
+	timeGranularity    time.Duration
+
+	Sizes sizeConfig `json:"sizes"`
+
+	// Errors the system under test may fail with where the reference
+	// file system wouldn't, by operation, e.g., {"tmpfile":
+	// ["EOPNOTSUPP"]} for file systems with no unnamed files. The
+	// reference file system must fail the same way, or succeed and be
+	// undone, see oper.undoer. Errors of seeks to data or holes are
+	// listed under "seek_holes", rather than "seek", e.g., ["EINVAL"] for
+	// file systems with no SEEK_DATA and SEEK_HOLE. Operations not listed
+	// keep their defaults, see defaultExpectedErrors.
+	ExpectedErrorsRaw  map[string][]string `json:"expected_errors"`
+	expectedErrors     map[operKind][]syscall.Errno
+	expectedHoleErrors []syscall.Errno
+
+	// Options musclefs is mounted with by the Linux 9p driver, besides
+	// the transport and the owner, e.g., "cache=mmap": with no cache,
+	// shared writable mappings fail with EINVAL, unless expected.
+	MountOptions string `json:"mount_options"`
+}
+
+// How lengths and offsets of operations are generated, in relation to
+// the block size of the system under test, see operSeq.randomLength and
+// operSeq.randomOffset.
+type sizeConfig struct {
+	// Also passed to musclefs.
+	BlockSize int `json:"block_size"`
+	// Lengths are up to this many blocks.
+	MaxBlocks int `json:"max_blocks"`
+	// Percentage of lengths and offsets that are a multiple of the block
+	// size, give or take one byte.
+	BoundaryProbability int `json:"boundary_probability"`
+	// Percentage of offsets anywhere up to MaxSparseOffset, which makes
+	// files with large holes.
+	SparseProbability int   `json:"sparse_probability"`
+	MaxSparseOffset   int64 `json:"max_sparse_offset"`
+}
+
+// The key of expected_errors for seeks to data or holes.
+const seekHolesKey = "seek_holes"
+
+var defaultSizes = sizeConfig{
+	BlockSize:           8192,
+	MaxBlocks:           16,
+	BoundaryProbability: 30,
+	SparseProbability:   1,
+	MaxSparseOffset:     4 << 30,
+}
+
+// Returns the errors expected unless the configuration lists others for
+// the same operation. Extended attributes may be unsupported, as they
+// are by musclefs, which the Linux 9p driver speaks 9P2000.u to. Seeks
+// are up to the file system, or rather the kernel: the Linux 9p driver
+// lets directories be seeked from the end, which tmpfs doesn't, and it
+// knows of no holes, so it finds data where ext4 and tmpfs fail.
+func defaultExpectedErrors() map[string][]string {
+	return map[string][]string{
+		"seek":        {"EINVAL"},
+		seekHolesKey:  {"EINVAL", "ENXIO"},
+		"setxattr":    {"EOPNOTSUPP"},
+		"getxattr":    {"EOPNOTSUPP"},
+		"listxattr":   {"EOPNOTSUPP"},
+		"removexattr": {"EOPNOTSUPP"},
+	}
 }
 
 func loadConfig(r io.Reader) (*config, error) {
-	var c config
+	// Fields not in the JSON keep their default values, and so do the
+	// expected errors of operations not in it.
+	c := config{Sizes: defaultSizes, ExpectedErrorsRaw: defaultExpectedErrors()}
 	if err := json.NewDecoder(r).Decode(&c); err != nil {
 		return nil, fmt.Errorf("loadConfig: decoding JSON: %v", err)
 	}
+	if s := c.Sizes; s.BlockSize <= 0 || s.MaxBlocks <= 0 || s.MaxSparseOffset <= 0 ||
+		s.BoundaryProbability < 0 || s.BoundaryProbability > 100 ||
+		s.SparseProbability < 0 || s.SparseProbability > 100 {
+		return nil, fmt.Errorf("loadConfig: bad sizes: %+v", s)
+	}
+	c.timeGranularity = time.Second
+	if c.TimeGranularityRaw != "" {
+		d, err := time.ParseDuration(c.TimeGranularityRaw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("loadConfig: bad time granularity %q", c.TimeGranularityRaw)
+		}
+		c.timeGranularity = d
+	}
+	c.expectedErrors = make(map[operKind][]syscall.Errno)
+	for operName, names := range c.ExpectedErrorsRaw {
+		var oper operKind
+		if operName != seekHolesKey {
+			var err error
+			if oper, err = lookupOperKind(operName); err != nil {
+				return nil, fmt.Errorf("loadConfig: %v in expected_errors", err)
+			}
+		}
+		var errnos []syscall.Errno
+		for _, name := range names {
+			errno := errnoByName(name)
+			if errno == 0 {
+				return nil, fmt.Errorf("loadConfig: unknown error %q for %s", name, operName)
+			}
+			errnos = append(errnos, errno)
+		}
+		if operName == seekHolesKey {
+			c.expectedHoleErrors = errnos
+		} else {
+			c.expectedErrors[oper] = errnos
+		}
+	}
 	c.probabilities = make(map[operKind]int)
 	if c.ProbabilitiesRaw == nil {
 		for oper := operKind(0); oper < operKindCount; oper++ {
@@ -47,7 +159,11 @@ func loadConfig(r io.Reader) (*config, error) {
 		c.rescaleProbabilities()
 	} else {
 		for operName, p := range c.ProbabilitiesRaw {
-			c.probabilities[fromString(operName)] = p
+			oper, err := lookupOperKind(operName)
+			if err != nil {
+				return nil, fmt.Errorf("loadConfig: %v in probabilities", err)
+			}
+			c.probabilities[oper] = p
 		}
 		if l := len(c.probabilities); l != int(operKindCount) {
 			return nil, fmt.Errorf("loadConfig: incomplete probabilities: %d/%d", l, operKindCount)
@@ -57,10 +173,31 @@ func loadConfig(r io.Reader) (*config, error) {
 	return &c, nil
 }
 
+// Names shared by two errors, of which unix.ErrnoName returns only one.
+var errnoAliases = map[string]syscall.Errno{
+	"EDEADLOCK":   syscall.EDEADLOCK,
+	"ENOTSUP":     syscall.ENOTSUP,
+	"EOPNOTSUPP":  syscall.EOPNOTSUPP,
+	"EWOULDBLOCK": syscall.EWOULDBLOCK,
+}
+
+// Returns the errno with the given name, e.g., "EOPNOTSUPP", or 0.
+func errnoByName(name string) syscall.Errno {
+	if e, ok := errnoAliases[name]; ok {
+		return e
+	}
+	for e := syscall.Errno(1); e < 256; e++ {
+		if unix.ErrnoName(e) == name {
+			return e
+		}
+	}
+	return 0
+}
+
 func (c *config) probabilityRanges() (ranges probabilityRanges) {
 	prev := 0
-	for oper, percentage := range c.probabilities {
-		curr := prev + percentage
+	for oper := operKind(0); oper < operKindCount; oper++ {
+		curr := prev + c.probabilities[oper]
 		ranges = append(ranges, struct {
 			upperBound int
 			oper       operKind
@@ -73,9 +210,43 @@ func (c *config) probabilityRanges() (ranges probabilityRanges) {
 	return
 }
 
-func (c *config) randomizeProbabilities() {
+// Disables the operations the systems under test don't support.
+func (c *config) restrict(fss [2]sut) error {
+	left := 0
+	for oper := operKind(0); oper < operKindCount; oper++ {
+		if c.probabilities[oper] != 0 && !supported(oper, fss) {
+			logInfo("config.restrict: disabling unsupported %v", oper)
+			c.probabilities[oper] = 0
+		}
+		left += c.probabilities[oper]
+	}
+	if left == 0 {
+		return fmt.Errorf("config.restrict: no operations left")
+	}
+	c.rescaleProbabilities()
+	return nil
+}
+
+// Disables the operations concurrent workers can't run.
+func (c *config) restrictConcurrent() error {
+	left := 0
+	for oper := operKind(0); oper < operKindCount; oper++ {
+		if c.probabilities[oper] != 0 && !oper.concurrent() {
+			logInfo("config.restrictConcurrent: disabling %v", oper)
+			c.probabilities[oper] = 0
+		}
+		left += c.probabilities[oper]
+	}
+	if left == 0 {
+		return fmt.Errorf("config.restrictConcurrent: no operations left")
+	}
+	c.rescaleProbabilities()
+	return nil
+}
+
+func (c *config) randomizeProbabilities(rng *rand.Rand) {
 	for oper := operKind(0); oper < operKindCount; oper++ {
-		c.probabilities[oper] = rand.Intn(100)
+		c.probabilities[oper] = rng.Intn(100)
 	}
 	c.rescaleProbabilities()
 }
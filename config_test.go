@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestExpectedErrorsNeedReferenceToAgree(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`{"expected_errors": {"tmpfile": ["EOPNOTSUPP"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := expectedErrors
+	expectedErrors = cfg.expectedErrors
+	defer func() {
+		expectedErrors = saved
+	}()
+	for _, c := range []struct {
+		referr error
+		want   bool
+	}{
+		{nil, true},
+		{syscall.EOPNOTSUPP, true},
+		{syscall.ENOENT, false},
+	} {
+		op := &oper{code: operTmpfile, suterr: syscall.EOPNOTSUPP, referr: c.referr}
+		if got := op.errorsMatch(); got != c.want {
+			t.Errorf("ref %v: got %v, want %v", c.referr, got, c.want)
+		}
+	}
+	op := &oper{code: operOpen, suterr: syscall.EOPNOTSUPP}
+	if op.errorsMatch() {
+		t.Error("got a match for an operation with no expected errors")
+	}
+}
+
+func TestExpectedErrorsKeepDefaultsOfOperationsNotListed(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`{"expected_errors": {"setxattr": []}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.expectedErrors[operSetxattr]; len(got) != 0 {
+		t.Errorf("setxattr: got %v, want none", got)
+	}
+	if got := cfg.expectedErrors[operGetxattr]; len(got) != 1 || got[0] != syscall.EOPNOTSUPP {
+		t.Errorf("getxattr: got %v, want [EOPNOTSUPP]", got)
+	}
+}
+
+func TestLoadConfigRejectsUnknownOperations(t *testing.T) {
+	for _, config := range []string{
+		`{"expected_errors": {"frobnicate": ["EIO"]}}`,
+		`{"probabilities": {"frobnicate": 1}}`,
+	} {
+		if _, err := loadConfig(strings.NewReader(config)); err == nil || !strings.Contains(err.Error(), `unknown operation "frobnicate"`) {
+			t.Errorf("%s: got %v, want an unknown operation error", config, err)
+		}
+	}
+}
+
+func TestRestrictRejectsNoOperationsLeft(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for oper := operKind(0); oper < operKindCount; oper++ {
+		if oper != operMuscleFlush {
+			cfg.probabilities[oper] = 0
+		}
+	}
+	if err := cfg.restrict([2]sut{&dirfs{}}); err == nil {
+		t.Error("got nil, want an error with only unsupported operations")
+	}
+}
+
+func TestExpectedSeekErrorsDependOnWhence(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`{"expected_errors": {"seek": [], "seek_holes": ["EINVAL"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedHoles := expectedErrors, expectedHoleErrors
+	expectedErrors, expectedHoleErrors = cfg.expectedErrors, cfg.expectedHoleErrors
+	defer func() {
+		expectedErrors, expectedHoleErrors = saved, savedHoles
+	}()
+	if op := (&oper{code: operSeek, whence: seekHole, suterr: syscall.EINVAL}); !op.expectedError() {
+		t.Error("got EINVAL unexpected for SEEK_HOLE")
+	}
+	if op := (&oper{code: operSeek, whence: io.SeekStart, suterr: syscall.EINVAL}); op.expectedError() {
+		t.Error("got EINVAL expected for SEEK_SET")
+	}
+}
+
+func TestExpectedErrorsOnTheReferenceOnlyAreForSeeks(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader(`{"expected_errors": {"tmpfile": ["EOPNOTSUPP"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := expectedErrors
+	expectedErrors = cfg.expectedErrors
+	defer func() {
+		expectedErrors = saved
+	}()
+	if op := (&oper{code: operSeek, whence: io.SeekEnd, referr: syscall.EINVAL}); !op.expectedError() {
+		t.Error("got EINVAL on the reference only unexpected for seek")
+	}
+	if op := (&oper{code: operTmpfile, referr: syscall.EOPNOTSUPP}); op.expectedError() {
+		t.Error("got EOPNOTSUPP on the reference only expected for tmpfile")
+	}
+}
@@ -0,0 +1,857 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The bits os.Chmod can set.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Reports whether, after the operation succeeds, the system under test
+// is expected to survive a crash with the whole state it has at that
+// point: the musclefs operations that flush it, or stop it cleanly, as
+// a remount does, which must not lose anything. Syncing a file only
+// persists that file, see syncs.
+func (op *oper) persists() bool {
+	switch op.code {
+	case operMuscleFlush, operMusclePush, operMuscleRemount, operMusclePruneCache, operSwapClients:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns the operation that opened the file the operation syncs, for
+// fsync, fdatasync, and msync if synchronous, else nil. Syncing
+// directories isn't tracked, nor is syncfs, which over the Linux 9p
+// driver doesn't even reach the server.
+func (op *oper) syncs() *oper {
+	switch op.code {
+	case operFsync, operFdatasync:
+		return op.parent
+	case operMsync:
+		if op.msflags&unix.MS_SYNC != 0 {
+			return op.parent.parent
+		}
+	}
+	return nil
+}
+
+// A file synced since the last durable state of the whole tree, under
+// one of its names, as it was on the reference file system then. After
+// a crash, the file must be found as it was under the name, unless it
+// has changed since, or the name was another file's when durable, which
+// a crash may bring back. Only fsync persists the metadata other than
+// the size.
+type syncedFile struct {
+	path       string
+	id         fileID
+	ctime      unix.Timespec
+	meta       bool
+	mode       uint32
+	size       int64
+	hash       []byte
+	revertible bool
+}
+
+// Reports whether any of the operations crashes the system under test.
+func crashes(opers []*oper) bool {
+	for _, op := range opers {
+		if op.code == operMuscleCrash {
+			return true
+		}
+	}
+	return false
+}
+
+// Updates what the system under test must have persisted, after the
+// operation succeeded there: everything, or the file synced. Syncing may
+// persist more than asked, up to everything, so the last durable state
+// then stops being all there is after a crash.
+func (seq *operSeq) saveDurability(op *oper) error {
+	switch {
+	case op.persists():
+		return seq.saveDurable()
+	case op.syncs() != nil:
+		seq.syncedSince = true
+		return seq.saveSynced(op)
+	case op.code == operFsync, op.code == operFdatasync, op.code == operSyncfs, op.code == operMsync:
+		seq.syncedSince = true
+	}
+	return nil
+}
+
+// Saves a copy of the reference file system, to compare against after
+// a crash of the system under test, which supersedes the files synced.
+func (seq *operSeq) saveDurable() error {
+	if err := replaceTree(refDir, seq.durableDir); err != nil {
+		return fmt.Errorf("operSeq.saveDurable: %v", err)
+	}
+	ids, err := fileIDs(refDir)
+	if err != nil {
+		return fmt.Errorf("operSeq.saveDurable: %v", err)
+	}
+	seq.durableIDs = ids
+	seq.synced = nil
+	seq.syncedSince = false
+	return nil
+}
+
+// Records the file synced by the operation, under each of its names on
+// the reference file system. Mappings whose file has been closed since
+// aren't tracked.
+func (seq *operSeq) saveSynced(op *oper) error {
+	f := op.syncs()
+	if !seq.isOpen(f) {
+		return nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(f.reffd, &st); err != nil {
+		return fmt.Errorf("operSeq.saveSynced: %v", err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil
+	}
+	id := fileID{st.Dev, st.Ino}
+	ids, err := fileIDs(refDir)
+	if err != nil {
+		return fmt.Errorf("operSeq.saveSynced: %v", err)
+	}
+	for p, other := range ids {
+		if other != id {
+			continue
+		}
+		durable, ok := seq.durableIDs[p]
+		hash, err := hashContent(filepath.Join(refDir, p))
+		if err != nil {
+			return fmt.Errorf("operSeq.saveSynced: %v", err)
+		}
+		seq.synced = append(seq.synced, syncedFile{
+			path:       p,
+			id:         id,
+			ctime:      st.Ctim,
+			meta:       op.code == operFsync,
+			mode:       st.Mode &^ unix.S_IFMT,
+			size:       st.Size,
+			hash:       hash,
+			revertible: ok && durable != id,
+		})
+	}
+	return nil
+}
+
+// Returns the last record of each name among the files synced, of those
+// still under it on the reference file system, unchanged since, unless
+// a crash may bring back the file the name was when durable.
+func (seq *operSeq) unchangedSynced() []syncedFile {
+	var unchanged []syncedFile
+	seen := make(map[string]bool)
+	for i := len(seq.synced) - 1; i >= 0; i-- {
+		f := seq.synced[i]
+		if seen[f.path] {
+			continue
+		}
+		seen[f.path] = true
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(refDir, f.path), &st); err != nil {
+			continue
+		}
+		if (fileID{st.Dev, st.Ino}) == f.id && st.Ctim == f.ctime && !f.revertible {
+			unchanged = append(unchanged, f)
+		}
+	}
+	return unchanged
+}
+
+// Checks the file synced is as it was under its name on the system
+// under test, reached through c at root.
+func (f *syncedFile) holds(c sysClient, root string) error {
+	fd, err := c.open(filepath.Join(root, f.path), unix.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("%q: %v, was there when synced", f.path, err)
+	}
+	defer func() {
+		_ = c.close(fd)
+	}()
+	var st unix.Stat_t
+	if err := c.fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("%q: mode %#o, was a regular file when synced", f.path, st.Mode)
+	}
+	if st.Size != f.size {
+		return fmt.Errorf("%q: size %d, was %d when synced", f.path, st.Size, f.size)
+	}
+	if mode := st.Mode &^ unix.S_IFMT; f.meta && mode != f.mode {
+		return fmt.Errorf("%q: mode %#o, was %#o when synced", f.path, mode, f.mode)
+	}
+	hash, err := hashContentFd(c, fd)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, f.hash) {
+		return fmt.Errorf("%q: contents differ from when synced", f.path)
+	}
+	return nil
+}
+
+// Returns the files other than directories in the tree at root, by path
+// relative to it.
+func fileIDs(root string) (map[string]fileID, error) {
+	ids := make(map[string]fileID)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		ids[rel] = fileID{st.Dev, st.Ino}
+		return nil
+	})
+	return ids, err
+}
+
+// Kills the system under test with all files open, then recovers it,
+// and rolls back the reference file system to the last durable state.
+// If anything was synced since, the system under test may have persisted
+// anything from then on, so the reference file system takes on what it
+// recovered instead, once checked, see operSeq.recovered. The files that were
+// open are opened again on both file systems, by replaying the
+// operations that opened them, and differing outcomes are reported as
+// an error. Those opened again on the reference file system are
+// recorded in op.reopened. Unnamed files are gone for good.
+func (seq *operSeq) crash(fs crasher, op *oper) error {
+	synced := seq.unchangedSynced()
+	if err := fs.kill(); err != nil {
+		return fmt.Errorf("operSeq.crash: %v", err)
+	}
+	// Mappings aren't restored either.
+	if err := seq.unmapAll(); err != nil {
+		return fmt.Errorf("operSeq.crash: %v", err)
+	}
+	reopen := seq.openOpers
+	// The sut file descriptors refer to the killed instance, so errors
+	// closing them are expected.
+	sc := sutClient()
+	for _, f := range reopen {
+		if err := sc.close(f.sutfd); err != nil {
+			logDebug("operSeq.crash: closing %d: %v", f.sutfd, err)
+		}
+		if err := syscall.Close(f.reffd); err != nil {
+			return fmt.Errorf("operSeq.crash: %v", err)
+		}
+	}
+	seq.openOpers = nil
+	if err := sc.close(seq.sutcwd); err != nil {
+		logDebug("operSeq.crash: closing %d: %v", seq.sutcwd, err)
+	}
+	seq.sutcwd = -1
+	if err := seq.closecwds(); err != nil {
+		return fmt.Errorf("operSeq.crash: %v", err)
+	}
+	if err := fs.recoverFromKill(); err != nil {
+		return fmt.Errorf("operSeq.crash: %v", err)
+	}
+	var mismatch error
+	durable := seq.durableDir
+	if seq.syncedSince {
+		recovered := filepath.Join(testDir, "recovered")
+		if err := seq.recovered(synced, recovered); err != nil {
+			mismatch = err
+		} else {
+			durable = recovered
+		}
+	}
+	if err := seq.restoreDurable(durable); err != nil {
+		return fmt.Errorf("operSeq.crash: %v", err)
+	}
+	sc = sutClient()
+	for _, f := range reopenable(reopen) {
+		flags := reopenFlags(f)
+		sutfd, suterr := sc.open(filepath.Join(filesystems[suti].mountpoint(), f.pathname), flags, 0)
+		reffd, referr := syscall.Open(filepath.Join(refDir, f.pathname), flags, 0)
+		if referr == nil {
+			op.reopened = append(op.reopened, f)
+		}
+		if suterr == nil && referr == nil {
+			f.sutfd = sutfd
+			f.reffd = reffd
+			f.dir = nil
+			seq.openOpers = append(seq.openOpers, f)
+			continue
+		}
+		if suterr == nil {
+			_ = sc.close(sutfd)
+		}
+		if referr == nil {
+			_ = syscall.Close(reffd)
+		}
+		if (suterr == nil) != (referr == nil) || (suterr != nil && suterr.Error() != referr.Error()) {
+			if mismatch == nil {
+				mismatch = fmt.Errorf("reopening %q for op %d: sut=%v ref=%v", f.pathname, f.id, suterr, referr)
+			}
+		}
+	}
+	return mismatch
+}
+
+// Checks the system under test, recovered from a crash with files
+// synced since the last durable state. The files synced, unchanged
+// since, must be as they were when synced, but for the metadata not
+// synced. Those changed since may be found as they were at any point
+// from then on, under the names synced, and so may the directories of
+// those names. Any other path must be either
+// as it was when durable, or as it was before the crash on the reference
+// file system. Makes a tree at dst of what's found, for the reference
+// file system to take on.
+func (seq *operSeq) recovered(synced []syncedFile, dst string) error {
+	logDebug("operSeq.recovered: checking %d files synced", len(synced))
+	sc := sutClient()
+	for _, f := range synced {
+		if err := f.holds(sc, filesystems[suti].mountpoint()); err != nil {
+			return fmt.Errorf("synced file: %v", err)
+		}
+	}
+	found, err := describeTree(filesystems[suti], "")
+	if err != nil {
+		return fmt.Errorf("operSeq.recovered: %v", err)
+	}
+	durable, err := describeTree(nil, seq.durableDir)
+	if err != nil {
+		return fmt.Errorf("operSeq.recovered: %v", err)
+	}
+	before, err := describeTree(nil, refDir)
+	if err != nil {
+		return fmt.Errorf("operSeq.recovered: %v", err)
+	}
+	// Along with their directories, which may have persisted with them.
+	syncedNames := make(map[string]bool)
+	for _, f := range seq.synced {
+		for p := f.path; p != "."; p = filepath.Dir(p) {
+			syncedNames[p] = true
+		}
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, m := range []map[string]string{found, durable, before} {
+		for p := range m {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	// From the reference file system, or from the system under test.
+	adopted := make(map[string]bool)
+	taken := make(map[string]bool)
+	for _, p := range paths {
+		switch {
+		case found[p] == durable[p]:
+		case found[p] == before[p]:
+			adopted[p] = true
+		case syncedNames[p]:
+			taken[p] = true
+		default:
+			logDebug("operSeq.recovered: found %q, was %q when durable, %q before the crash", found[p], durable[p], before[p])
+			return fmt.Errorf("recovered %q: neither as last durable nor as before the crash", p)
+		}
+	}
+	if err := seq.mergeStates(adopted, taken, dst); err != nil {
+		return fmt.Errorf("operSeq.recovered: %v", err)
+	}
+	return nil
+}
+
+// Describes each path of the tree of the system under test if fs isn't
+// nil, else of the one at root, cf. hashTree.
+func describeTree(fs sut, root string) (map[string]string, error) {
+	var desc []byte
+	var err error
+	if fs != nil {
+		desc, err = hashSUT(fs, true, true, false)
+	} else {
+		desc, err = hashTree(root, true, true, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return describedPaths(desc)
+}
+
+// Makes a tree at dst of the last durable state, except for the paths
+// adopted, taken from the reference file system, and those taken from
+// the system under test, either removed if not there.
+func (seq *operSeq) mergeStates(adopted, taken map[string]bool, dst string) error {
+	if err := replaceTree(seq.durableDir, dst); err != nil {
+		return err
+	}
+	// Directories are writable meanwhile, and get their modes and times
+	// last, as in copyTree.
+	err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		return os.Chmod(path, 0700)
+	})
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for p := range adopted {
+		paths = append(paths, p)
+	}
+	for p := range taken {
+		paths = append(paths, p)
+	}
+	// Parents first.
+	sort.Strings(paths)
+	copied := make(map[fileID]string)
+	copiedFromSUT := make(map[uint64]string)
+	sutDirs := make(map[string]*unix.Stat_t)
+	for _, p := range paths {
+		target := filepath.Join(dst, p)
+		if taken[p] {
+			st, err := copyFromSUT(filepath.Join(filesystems[suti].mountpoint(), p), target, copiedFromSUT)
+			if err == syscall.ENOENT {
+				err = removeTree(target)
+			}
+			if err != nil {
+				return err
+			}
+			if st != nil {
+				sutDirs[p] = st
+			}
+			continue
+		}
+		src := filepath.Join(refDir, p)
+		info, err := os.Lstat(src)
+		if os.IsNotExist(err) {
+			if err := removeTree(target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if t, err := os.Lstat(target); err == nil && t.IsDir() {
+				continue
+			}
+		}
+		if err := removeTree(target); err != nil {
+			return err
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		id := fileID{st.Dev, st.Ino}
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			err = copyXattrs(src, target)
+		case copied[id] != "":
+			err = os.Link(copied[id], target)
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(src); err == nil {
+				if err = os.Symlink(link, target); err == nil {
+					err = copyTimes(target, info)
+				}
+			}
+		default:
+			copied[id] = target
+			if err = copyFile(src, target, info.Mode()&modeBits); err == nil {
+				err = copyTimes(target, info)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var dirs []string
+	err = filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dst, dirs[i])
+		if err != nil {
+			return err
+		}
+		if st, ok := sutDirs[rel]; ok {
+			if err := unix.Chmod(dirs[i], st.Mode&^unix.S_IFMT); err != nil {
+				return err
+			}
+			times := []unix.Timespec{st.Atim, st.Mtim}
+			if err := unix.UtimesNanoAt(unix.AT_FDCWD, dirs[i], times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+				return err
+			}
+			continue
+		}
+		src := seq.durableDir
+		if adopted[rel] || (rel == "." && adopted[""]) {
+			src = refDir
+		}
+		info, err := os.Lstat(filepath.Join(src, rel))
+		if err != nil {
+			return err
+		}
+		if err := copyTimes(dirs[i], info); err != nil {
+			return err
+		}
+		if err := os.Chmod(dirs[i], info.Mode()&modeBits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the file at path on the system under test to dst, along with
+// its mode, times and extended attributes, leaving holes as copySparse
+// does. Files with more links are linked to their first copy, by inode
+// number in copied. Directories are only made, if not there, and their
+// attributes returned, for the caller to set once done with their
+// children, as in copyTree.
+func copyFromSUT(path, dst string, copied map[uint64]string) (*unix.Stat_t, error) {
+	c := sutClient()
+	fd, err := c.open(path, unix.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.close(fd)
+	}()
+	var st unix.Stat_t
+	if err := c.fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		if info, err := os.Lstat(dst); err == nil && info.IsDir() {
+			names, err := userXattrs(dst)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if err := unix.Lremovexattr(dst, name); err != nil {
+					return nil, err
+				}
+			}
+		} else {
+			if err := removeTree(dst); err != nil {
+				return nil, err
+			}
+			if err := os.Mkdir(dst, 0700); err != nil {
+				return nil, err
+			}
+		}
+		return &st, copyXattrsFromSUT(c, path, dst)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil, fmt.Errorf("copyFromSUT: %q: mode %#o, neither a regular file nor a directory", path, st.Mode)
+	}
+	if err := removeTree(dst); err != nil {
+		return nil, err
+	}
+	if first, ok := copied[st.Ino]; ok {
+		return nil, os.Link(first, dst)
+	}
+	if st.Nlink > 1 {
+		copied[st.Ino] = dst
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = readData(c, fd, func(p []byte, offset int64) error {
+		_, err := out.WriteAt(p, offset)
+		return err
+	})
+	if err == nil {
+		err = out.Truncate(st.Size)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Before the mode may deny writing, as in copyFile.
+	if err := copyXattrsFromSUT(c, path, dst); err != nil {
+		return nil, err
+	}
+	if err := unix.Chmod(dst, st.Mode&^unix.S_IFMT); err != nil {
+		return nil, err
+	}
+	times := []unix.Timespec{st.Atim, st.Mtim}
+	return nil, unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// Like copyXattrs, from a file on the system under test, reached
+// through c.
+func copyXattrsFromSUT(c sysClient, path, dst string) error {
+	list := make([]byte, 64<<10)
+	n, err := c.listxattr(path, list)
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 64<<10)
+	for _, name := range xattrNames(list[:n]) {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		n, err := c.getxattr(path, name, value)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value[:n], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the operations that opened files by name, which can be
+// opened again, as opposed to those of O_TMPFILE, or duplicates, whose
+// offset can't be shared with a file opened again.
+func reopenable(opers []*oper) []*oper {
+	var named []*oper
+	for _, op := range opers {
+		if op.code != operTmpfile && op.code != operDup {
+			named = append(named, op)
+		}
+	}
+	return named
+}
+
+// Returns the flags to open again the file opened by the operation.
+// They don't create, fail, or truncate, because of the replay.
+func reopenFlags(op *oper) int {
+	flags := int(op.flags)
+	if op.code == operCreate {
+		flags = createFlags
+	}
+	return flags &^ (syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC)
+}
+
+// Replaces the reference file system with its durable state at src,
+// the last saved or the one recovered from a crash, and updates the
+// bookkeeping accordingly.
+func (seq *operSeq) restoreDurable(src string) error {
+	if err := replaceTree(src, refDir); err != nil {
+		return fmt.Errorf("operSeq.restoreDurable: %v", err)
+	}
+	if err := seq.saveDurable(); err != nil {
+		return fmt.Errorf("operSeq.restoreDurable: %v", err)
+	}
+	if err := seq.rescan(); err != nil {
+		return fmt.Errorf("operSeq.restoreDurable: %v", err)
+	}
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	if seq.cwdpath != "" && !seq.existingDirs.has(seq.cwdpath) {
+		logDebug("operSeq.restoreDurable: cwd %q lost, moving to the root", seq.cwdpath)
+		seq.cwdpath = ""
+	}
+	return nil
+}
+
+// Replaces the tree at dst with a copy of the one at src.
+func replaceTree(src, dst string) error {
+	if err := removeTree(dst); err != nil {
+		return err
+	}
+	return copyTree(src, dst)
+}
+
+// Like os.RemoveAll, but first making directories writable, as they may
+// not be after chmod operations.
+func removeTree(path string) error {
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.Chmod(p, 0700)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// Copies the tree of directories, regular files and symbolic links at
+// src to dst, which must not exist, preserving permissions, times and
+// extended attributes in the user namespace, and hard links: later
+// names of a file are linked to the first copied.
+func copyTree(src, dst string) error {
+	type dir struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dir
+	copied := make(map[fileID]string)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			dirs = append(dirs, dir{path: target, info: info})
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			return copyXattrs(path, target)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		id := fileID{st.Dev, st.Ino}
+		if first, ok := copied[id]; ok {
+			return os.Link(first, target)
+		}
+		if st.Nlink > 1 {
+			copied[id] = target
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return copyTimes(target, info)
+		}
+		if err := copyFile(path, target, info.Mode()&modeBits); err != nil {
+			return err
+		}
+		return copyTimes(target, info)
+	})
+	if err != nil {
+		return err
+	}
+	// Children first, in case a directory is not writable, and as
+	// creating them changes the times of the parent.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyTimes(dirs[i].path, dirs[i].info); err != nil {
+			return err
+		}
+		if err := os.Chmod(dirs[i].path, dirs[i].info.Mode()&modeBits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the data of src to dst, leaving holes where src has them, so
+// that copies of sparse files don't take up more room.
+func copySparse(dst, src *os.File) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for {
+		data, err := src.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, io.NewSectionReader(src, data, hole-data)); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return dst.Truncate(fi.Size())
+}
+
+func copyXattrs(src, dst string) error {
+	names, err := userXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the access and modification times of the file at dst, not
+// following symbolic links, to those described by info.
+func copyTimes(dst string, info os.FileInfo) error {
+	st := info.Sys().(*syscall.Stat_t)
+	times := []unix.Timespec{unix.NsecToTimespec(st.Atim.Nano()), unix.NsecToTimespec(st.Mtim.Nano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := copySparse(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// Before the mode may deny writing.
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const creproHeader = `/*
+Generated by fsdiff. Build and run with
+	gcc -Wall repro.c -o repro && cd /path/to/mnt && ./repro
+The expected results are those of the reference file system.
+*/
+#define _GNU_SOURCE
+#include <errno.h>
+#include <fcntl.h>
+#include <limits.h>
+#include <setjmp.h>
+#include <signal.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/mman.h>
+#include <sys/stat.h>
+#include <sys/syscall.h>
+#include <sys/types.h>
+#include <sys/uio.h>
+#include <sys/vfs.h>
+#include <sys/xattr.h>
+#include <unistd.h>
+
+static char root[PATH_MAX];
+static char buf[%d];
+static struct stat st;
+
+// Maps a pathname relative to the root to an absolute one.
+// Alternates between two buffers, enough for rename.
+static const char *
+P(const char *rel)
+{
+	static char paths[2][2*PATH_MAX];
+	static int i;
+
+	i = 1 - i;
+	snprintf(paths[i], sizeof paths[i], "%%s/%%s", root, rel);
+	return paths[i];
+}
+
+// The path under /proc to link a file descriptor by.
+static const char *
+F(int fd)
+{
+	static char path[32];
+
+	snprintf(path, sizeof path, "/proc/self/fd/%%d", fd);
+	return path;
+}
+
+static sigjmp_buf faulted;
+
+static void
+onfault(int sig)
+{
+	siglongjmp(faulted, 1);
+}
+
+// Copies through a mapping, failing with EFAULT where a load or store
+// faults, e.g., with SIGBUS for pages past the end of the file. Bytes
+// are copied one at a time, in order, as fsdiff does.
+static long
+mcopy(void *dst, const void *src, size_t n)
+{
+	struct sigaction sa, oldbus, oldsegv;
+	volatile char *d = dst;
+	const volatile char *s = src;
+	size_t i;
+	long r;
+
+	memset(&sa, 0, sizeof sa);
+	sa.sa_handler = onfault;
+	sigaction(SIGBUS, &sa, &oldbus);
+	sigaction(SIGSEGV, &sa, &oldsegv);
+	if (sigsetjmp(faulted, 1) == 0) {
+		for (i = 0; i < n; i++)
+			d[i] = s[i];
+		r = n;
+	} else {
+		errno = EFAULT;
+		r = -1;
+	}
+	sigaction(SIGBUS, &oldbus, NULL);
+	sigaction(SIGSEGV, &oldsegv, NULL);
+	return r;
+}
+
+int
+ctl(const char *cmd)
+{
+	int fd, saved;
+	ssize_t n;
+
+	fd = open(P("ctl"), O_RDWR|O_CREAT, 0666);
+	if (fd < 0)
+		return -1;
+	n = write(fd, cmd, strlen(cmd));
+	saved = errno;
+	close(fd);
+	errno = saved;
+	return n < 0 ? -1 : 0;
+}
+
+static void
+expect(const char *call, long got, long want, int wanterrno)
+{
+	if (wanterrno != 0) {
+		if (got != -1 || errno != wanterrno) {
+			fprintf(stderr, "%%s: got %%ld (%%s), want -1 (%%s)\n", call, got, strerror(errno), strerror(wanterrno));
+			exit(1);
+		}
+	} else if (got != want) {
+		fprintf(stderr, "%%s: got %%ld (%%s), want %%ld\n", call, got, strerror(errno), want);
+		exit(1);
+	}
+}
+
+static void
+expectfd(const char *call, int got, int wanterrno)
+{
+	if (wanterrno != 0)
+		expect(call, got, -1, wanterrno);
+	else if (got < 0) {
+		fprintf(stderr, "%%s: got %%d (%%s), want a file descriptor\n", call, got, strerror(errno));
+		exit(1);
+	}
+}
+
+void
+expectfail(const char *call, int got, int wantfail)
+{
+	if ((got < 0) != wantfail) {
+		fprintf(stderr, "%%s: got %%d (%%s), want failure=%%d\n", call, got, strerror(errno), wantfail);
+		exit(1);
+	}
+}
+
+int
+main(int argc, char **argv)
+{
+	int cwd;
+
+	if (getcwd(root, sizeof root) == NULL) {
+		perror("getcwd");
+		return 1;
+	}
+	cwd = open(".", O_RDONLY|O_DIRECTORY|O_CLOEXEC);
+	expectfd("open(\".\")", cwd, 0);
+	umask(0%o);
+`
+
+const creproFooter = `
+	return 0;
+}
+`
+
+// Returns the name of the errno constant for the error, and false if
+// the error is not an errno.
+func cErrno(err error) (string, bool) {
+	if e, ok := err.(syscall.Errno); ok {
+		if name := unix.ErrnoName(e); name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func cBytes(b []byte) string {
+	var s bytes.Buffer
+	s.WriteByte('"')
+	for _, c := range b {
+		_, _ = fmt.Fprintf(&s, "\\x%02x", c)
+	}
+	s.WriteByte('"')
+	return s.String()
+}
+
+// Returns a C statement asserting that the call gives the wanted
+// result, or fails with the given error.
+func cExpect(call string, want int64, err error) string {
+	if err == nil {
+		return fmt.Sprintf("expect(%q, %s, %d, 0);", call, call, want)
+	}
+	if name, ok := cErrno(err); ok {
+		return fmt.Sprintf("expect(%q, %s, -1, %s);", call, call, name)
+	}
+	return fmt.Sprintf("expectfail(%q, %s, 1);", call, call)
+}
+
+// Like cExpect, for calls that return a new file descriptor, assigned
+// to the given variable.
+func cExpectFd(variable string, call string, err error) string {
+	errno := "0"
+	if err != nil {
+		if name, ok := cErrno(err); ok {
+			errno = name
+		} else {
+			return fmt.Sprintf("%s = %s;\n\texpectfail(%q, %s, 1);", variable, call, call, variable)
+		}
+	}
+	return fmt.Sprintf("%s = %s;\n\texpectfd(%q, %s, %s);", variable, call, call, variable, errno)
+}
+
+// Returns C statements, each preceded by a newline, asserting that st
+// matches the summary, cf. statSummary.
+func cStatExpect(summary string) string {
+	var s string
+	for _, field := range strings.Fields(summary) {
+		kv := strings.SplitN(field, "=", 2)
+		n, err := strconv.ParseInt(kv[1], 0, 64)
+		if err != nil {
+			return fmt.Sprintf("\n\t// Unexpected %q in %q.", field, summary)
+		}
+		s += "\n\t" + cExpect(fmt.Sprintf("(long)st.st_%s", kv[0]), n, nil)
+	}
+	return s
+}
+
+// Returns a C array of timespecs, as passed to utimensat and futimens.
+func cTimes(times []unix.Timespec) string {
+	var parts []string
+	for _, ts := range times {
+		switch ts.Nsec {
+		case unix.UTIME_NOW:
+			parts = append(parts, "{0, UTIME_NOW}")
+		case unix.UTIME_OMIT:
+			parts = append(parts, "{0, UTIME_OMIT}")
+		default:
+			parts = append(parts, fmt.Sprintf("{%d, %d}", ts.Sec, ts.Nsec))
+		}
+	}
+	return "(struct timespec[]){" + strings.Join(parts, ", ") + "}"
+}
+
+// Returns a C array of iovecs of the given lengths, over consecutive
+// parts of the data if not nil, else of buf.
+func cIov(lens []int, data []byte) string {
+	var parts []string
+	offset := 0
+	for _, l := range lens {
+		if data != nil {
+			parts = append(parts, fmt.Sprintf("{%s, %d}", cBytes(data[offset:offset+l]), l))
+		} else {
+			parts = append(parts, fmt.Sprintf("{buf + %d, %d}", offset, l))
+		}
+		offset += l
+	}
+	return "(struct iovec[]){" + strings.Join(parts, ", ") + "}"
+}
+
+func cBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Like cExpectFd, for mmap(2), which fails with MAP_FAILED.
+func cExpectMap(variable string, call string, err error) string {
+	got := variable + " == MAP_FAILED ? -1 : 0"
+	errno := "0"
+	if err != nil {
+		if name, ok := cErrno(err); ok {
+			errno = name
+		} else {
+			return fmt.Sprintf("%s = %s;\n\texpectfail(%q, %s, 1);", variable, call, call, got)
+		}
+	}
+	return fmt.Sprintf("%s = %s;\n\texpectfd(%q, %s, %s);", variable, call, call, got, errno)
+}
+
+func cMsyncFlags(flags int) string {
+	var names []string
+	for _, f := range []struct {
+		flag int
+		name string
+	}{{unix.MS_ASYNC, "MS_ASYNC"}, {unix.MS_SYNC, "MS_SYNC"}, {unix.MS_INVALIDATE, "MS_INVALIDATE"}} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+func cFallocateMode(mode uint32) string {
+	var names []string
+	for _, f := range []struct {
+		flag uint32
+		name string
+	}{{unix.FALLOC_FL_KEEP_SIZE, "FALLOC_FL_KEEP_SIZE"}, {unix.FALLOC_FL_PUNCH_HOLE, "FALLOC_FL_PUNCH_HOLE"}} {
+		if mode&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+func cWhence(whence int) string {
+	switch whence {
+	case io.SeekStart:
+		return "SEEK_SET"
+	case io.SeekCurrent:
+		return "SEEK_CUR"
+	case io.SeekEnd:
+		return "SEEK_END"
+	case seekData:
+		return "SEEK_DATA"
+	case seekHole:
+		return "SEEK_HOLE"
+	default:
+		return fmt.Sprint(whence)
+	}
+}
+
+func cRenameFlags(flags uint) string {
+	switch flags {
+	case unix.RENAME_NOREPLACE:
+		return "RENAME_NOREPLACE"
+	case unix.RENAME_EXCHANGE:
+		return "RENAME_EXCHANGE"
+	default:
+		return fmt.Sprint(flags)
+	}
+}
+
+func cFcntlCmd(cmd int) string {
+	switch cmd {
+	case unix.F_DUPFD:
+		return "F_DUPFD"
+	case unix.F_DUPFD_CLOEXEC:
+		return "F_DUPFD_CLOEXEC"
+	default:
+		return fmt.Sprint(cmd)
+	}
+}
+
+func cFd(op *oper) string {
+	return fmt.Sprintf("fd%d", op.id)
+}
+
+// The variable for the mapping of an mmap operation.
+func cMap(op *oper) string {
+	return fmt.Sprintf("m%d", op.id)
+}
+
+// Writes a standalone C program that runs the operations and checks
+// that their results match those of the reference file system. The
+// program is meant to be run from the root of the file system under
+// test. Operations specific to musclefs become writes to its ctl file.
+func writeCRepro(w io.Writer, ops []*oper) error {
+	seq := &operSeq{
+		existingDirs:  newPathSet(),
+		existingFiles: newPathSet(),
+		existingLinks: newPathSet(),
+		aliases:       newAliasMap(),
+		sutcwd:        -1,
+		refcwd:        -1,
+	}
+	bufSize := 1
+	for _, op := range ops {
+		if (op.code == operRead || op.code == operPread || op.code == operMread || op.code == operGetdents || op.code == operReadlink || op.code == operGetxattr || op.code == operListxattr) && op.rbuf >= bufSize {
+			bufSize = op.rbuf + 1
+		}
+		if op.code == operReadv {
+			size := 0
+			for _, l := range op.iov {
+				size += l
+			}
+			if size >= bufSize {
+				bufSize = size + 1
+			}
+		}
+	}
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, creproHeader, bufSize, umask)
+	reopenCwd := func() {
+		b.WriteString("\t" + cExpectFd("cwd", fmt.Sprintf("open(P(%q), O_RDONLY|O_DIRECTORY|O_CLOEXEC)", seq.cwdpath), nil) + "\n")
+	}
+	closeAll := func() {
+		for _, m := range seq.mappedOpers {
+			_, _ = fmt.Fprintf(&b, "\t(void)munmap(%s, %d);\n", cMap(m), m.length)
+		}
+		seq.mappedOpers = nil
+		for _, f := range seq.openOpers {
+			_, _ = fmt.Fprintf(&b, "\t(void)close(%s);\n", cFd(f))
+		}
+		b.WriteString("\t(void)close(cwd);\n")
+		seq.openOpers = nil
+		reopenCwd()
+	}
+	for _, op := range ops {
+		if op.parent != nil {
+			_, _ = fmt.Fprintf(&b, "\n\t// id=%d code=%v parent=%d\n", op.id, op.code, op.parent.id)
+		} else {
+			_, _ = fmt.Fprintf(&b, "\n\t// id=%d code=%v\n", op.id, op.code)
+		}
+		var stmt string
+		switch op.code {
+		case operCreate:
+			stmt = "int " + cExpectFd(cFd(op), fmt.Sprintf("openat(cwd, %q, O_CREAT|O_WRONLY|O_TRUNC, 0%o)", seq.relativize(op.pathname), op.mode), op.referr)
+		case operOpen, operTmpfile:
+			// Numeric flags, because some have different values in C, e.g., O_LARGEFILE is 0 on 64-bit systems.
+			stmt = "int " + cExpectFd(cFd(op), fmt.Sprintf("openat(cwd, %q, %#o /* %v */, 0%o)", seq.relativize(op.pathname), int(op.flags), op.flags, op.mode), op.referr)
+		case operDup:
+			var call string
+			switch op.cmd {
+			case cmdDup:
+				call = fmt.Sprintf("dup(%s)", cFd(op.parent))
+			case cmdDup3:
+				call = fmt.Sprintf("dup3(%s, %s, %#o /* %v */)", cFd(op.parent), cFd(op.replaced), int(op.flags), op.flags)
+			default:
+				call = fmt.Sprintf("fcntl(%s, %s, %d)", cFd(op.parent), cFcntlCmd(op.cmd), dupMinFd)
+			}
+			stmt = "int " + cExpectFd(cFd(op), call, op.referr)
+		case operSeek:
+			call := fmt.Sprintf("lseek(%s, %d, %s)", cFd(op.parent), op.offset, cWhence(op.whence))
+			switch {
+			case op.referr != nil:
+				// Having failed on one file system only, as expected, it
+				// was undone on the other, see operSeq.run.
+				stmt = fmt.Sprintf("{ off_t o = lseek(%s, 0, SEEK_CUR); %s (void)lseek(%s, o, SEEK_SET); }", cFd(op.parent), cExpect(call, op.refoff, op.referr), cFd(op.parent))
+			case !seeksHoles(op.whence):
+				stmt = cExpect(call, op.refoff, op.referr)
+			default:
+				// Where data and holes are is up to the file system, so
+				// this goes on from where the reference file system went.
+				stmt = fmt.Sprintf("(void)%s;\n\t", call) + cExpect(fmt.Sprintf("lseek(%s, %d, SEEK_SET)", cFd(op.parent), op.refoff), op.refoff, nil)
+			}
+		case operRead:
+			stmt = cExpect(fmt.Sprintf("read(%s, buf, %d)", cFd(op.parent), op.rbuf), int64(op.refn), op.referr)
+			if op.referr == nil && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operWrite:
+			stmt = cExpect(fmt.Sprintf("write(%s, %s, %d)", cFd(op.parent), cBytes(op.wbuf), len(op.wbuf)), int64(op.refn), op.referr)
+		case operClose:
+			stmt = cExpect(fmt.Sprintf("close(%s)", cFd(op.parent)), 0, op.referr)
+		case operPread:
+			stmt = cExpect(fmt.Sprintf("pread(%s, buf, %d, %d)", cFd(op.parent), op.rbuf, op.offset), int64(op.refn), op.referr)
+			if op.referr == nil && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operPwrite:
+			stmt = cExpect(fmt.Sprintf("pwrite(%s, %s, %d, %d)", cFd(op.parent), cBytes(op.wbuf), len(op.wbuf), op.offset), int64(op.refn), op.referr)
+		case operReadv:
+			stmt = cExpect(fmt.Sprintf("readv(%s, %s, %d)", cFd(op.parent), cIov(op.iov, nil), len(op.iov)), int64(op.refn), op.referr)
+			if op.referr == nil && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operWritev:
+			stmt = cExpect(fmt.Sprintf("writev(%s, %s, %d)", cFd(op.parent), cIov(op.iov, op.wbuf), len(op.iov)), int64(op.refn), op.referr)
+		case operGetdents:
+			// Only success is checked, as the order of the entries is unspecified.
+			call := fmt.Sprintf("syscall(SYS_getdents64, %s, buf, %d)", cFd(op.parent), op.rbuf)
+			if op.referr == nil {
+				stmt = fmt.Sprintf("expectfail(%q, %s, 0);", call, call)
+			} else {
+				stmt = cExpect(call, 0, op.referr)
+			}
+		case operFsync, operFdatasync, operSyncfs:
+			fd := "cwd"
+			if op.parent != nil {
+				fd = cFd(op.parent)
+			}
+			stmt = cExpect(fmt.Sprintf("%v(%s)", op.code, fd), 0, op.referr)
+		case operMmap:
+			call := fmt.Sprintf("mmap(NULL, %d, PROT_READ|PROT_WRITE, MAP_SHARED, %s, %d)", op.length, cFd(op.parent), op.offset)
+			stmt = "char *" + cExpectMap(cMap(op), call, op.referr)
+		case operMread:
+			stmt = cExpect(fmt.Sprintf("mcopy(buf, %s + %d, %d)", cMap(op.parent), op.offset, op.rbuf), int64(op.refn), op.referr)
+			if op.referr == nil && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operMwrite:
+			stmt = cExpect(fmt.Sprintf("mcopy(%s + %d, %s, %d)", cMap(op.parent), op.offset, cBytes(op.wbuf), len(op.wbuf)), int64(op.refn), op.referr)
+		case operMsync:
+			stmt = cExpect(fmt.Sprintf("msync(%s, %d, %s)", cMap(op.parent), op.parent.length, cMsyncFlags(op.msflags)), 0, op.referr)
+		case operMunmap:
+			stmt = cExpect(fmt.Sprintf("munmap(%s, %d)", cMap(op.parent), op.parent.length), 0, op.referr)
+		case operUnlink1:
+			stmt = cExpect(fmt.Sprintf("unlinkat(cwd, %q, 0)", seq.relativize(op.pathname)), 0, op.referr)
+		case operUnlink2:
+			stmt = fmt.Sprintf("expectfail(\"unlink2\", ctl(%q), %d);", "unlink "+op.pathname, cBool(op.referr != nil))
+		case operTruncate:
+			stmt = cExpect(fmt.Sprintf("truncate(P(%q), %d)", op.pathname, op.rbuf), 0, op.referr)
+		case operFtruncate:
+			stmt = cExpect(fmt.Sprintf("ftruncate(%s, %d)", cFd(op.parent), op.rbuf), 0, op.referr)
+		case operFallocate:
+			stmt = cExpect(fmt.Sprintf("fallocate(%s, %s, %d, %d)", cFd(op.parent), cFallocateMode(op.mode), op.offset, op.length), 0, op.referr)
+		case operMkdir:
+			stmt = cExpect(fmt.Sprintf("mkdirat(cwd, %q, 0%o)", seq.relativize(op.pathname), op.mode), 0, op.referr)
+		case operRmdir:
+			stmt = cExpect(fmt.Sprintf("unlinkat(cwd, %q, AT_REMOVEDIR)", seq.relativize(op.pathname)), 0, op.referr)
+		case operRename1:
+			stmt = cExpect(fmt.Sprintf("rename(P(%q), P(%q))", op.pathname, op.newpathname), 0, op.referr)
+		case operRename2:
+			stmt = fmt.Sprintf("expectfail(\"rename2\", ctl(%q), %d);", fmt.Sprintf("rename %s %s", op.pathname, op.newpathname), cBool(op.referr != nil))
+		case operRenameat2:
+			stmt = cExpect(fmt.Sprintf("renameat2(cwd, %q, cwd, %q, %s)", seq.relativize(op.pathname), seq.relativize(op.newpathname), cRenameFlags(op.rflags)), 0, op.referr)
+		case operChdir:
+			stmt = cExpect("close(cwd)", 0, nil) + "\n\t" + cExpectFd("cwd", fmt.Sprintf("open(P(%q), O_RDONLY|O_DIRECTORY|O_CLOEXEC)", op.pathname), op.referr)
+			if op.referr != nil {
+				b.WriteString("\t" + stmt + "\n")
+				reopenCwd()
+				stmt = ""
+			}
+		case operSymlink:
+			stmt = cExpect(fmt.Sprintf("symlinkat(%q, cwd, %q)", op.target, seq.relativize(op.pathname)), 0, op.referr)
+		case operReadlink:
+			stmt = cExpect(fmt.Sprintf("readlinkat(cwd, %q, buf, %d)", seq.relativize(op.pathname), op.rbuf), int64(op.refn), op.referr)
+			if op.referr == nil && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operLstat:
+			stmt = cExpect(fmt.Sprintf("fstatat(cwd, %q, &st, AT_SYMLINK_NOFOLLOW)", seq.relativize(op.pathname)), 0, op.referr)
+			if op.referr == nil {
+				stmt += cStatExpect(op.refstat)
+			}
+		case operStat:
+			stmt = cExpect(fmt.Sprintf("fstatat(cwd, %q, &st, 0)", seq.relativize(op.pathname)), 0, op.referr)
+			if op.referr == nil {
+				stmt += cStatExpect(op.refstat)
+			}
+		case operFstat:
+			stmt = cExpect(fmt.Sprintf("fstat(%s, &st)", cFd(op.parent)), 0, op.referr)
+			if op.referr == nil {
+				stmt += cStatExpect(op.refstat)
+			}
+		case operStatfs:
+			stmt = cExpect(fmt.Sprintf("statfs(P(%q), &(struct statfs){0})", op.pathname), 0, op.referr)
+		case operLink:
+			stmt = cExpect(fmt.Sprintf("linkat(cwd, %q, cwd, %q, 0)", seq.relativize(op.pathname), seq.relativize(op.newpathname)), 0, op.referr)
+		case operFlink:
+			if op.atflags&unix.AT_EMPTY_PATH != 0 {
+				stmt = cExpect(fmt.Sprintf("linkat(%s, \"\", cwd, %q, AT_EMPTY_PATH)", cFd(op.parent), seq.relativize(op.newpathname)), 0, op.referr)
+			} else {
+				stmt = cExpect(fmt.Sprintf("linkat(AT_FDCWD, F(%s), cwd, %q, AT_SYMLINK_FOLLOW)", cFd(op.parent), seq.relativize(op.newpathname)), 0, op.referr)
+			}
+		case operChmod:
+			stmt = cExpect(fmt.Sprintf("chmod(P(%q), 0%o)", op.pathname, op.mode), 0, op.referr)
+		case operFchmod:
+			stmt = cExpect(fmt.Sprintf("fchmod(%s, 0%o)", cFd(op.parent), op.mode), 0, op.referr)
+		case operFchmodat:
+			stmt = cExpect(fmt.Sprintf("fchmodat(cwd, %q, 0%o, 0)", seq.relativize(op.pathname), op.mode), 0, op.referr)
+		case operAccess:
+			stmt = cExpect(fmt.Sprintf("faccessat(cwd, %q, %d, 0)", seq.relativize(op.pathname), op.mode), 0, op.referr)
+		case operUtimensat:
+			stmt = cExpect(fmt.Sprintf("utimensat(cwd, %q, %s, %#x)", seq.relativize(op.pathname), cTimes(op.times), op.atflags), 0, op.referr)
+		case operFutimens:
+			stmt = cExpect(fmt.Sprintf("futimens(%s, %s)", cFd(op.parent), cTimes(op.times)), 0, op.referr)
+		case operSetxattr:
+			stmt = cExpect(fmt.Sprintf("setxattr(P(%q), %q, %s, %d, %d)", op.pathname, op.xattr, cBytes(op.wbuf), len(op.wbuf), op.xflags), 0, op.referr)
+		case operGetxattr:
+			stmt = cExpect(fmt.Sprintf("getxattr(P(%q), %q, buf, %d)", op.pathname, op.xattr, op.rbuf), int64(op.refn), op.referr)
+			if op.referr == nil && op.rbuf > 0 && op.refn > 0 {
+				stmt += "\n\t" + cExpect(fmt.Sprintf("memcmp(buf, %s, %d)", cBytes(op.refbuf[:op.refn]), op.refn), 0, nil)
+			}
+		case operListxattr:
+			// Only the size is checked, as the order of the names is unspecified.
+			stmt = cExpect(fmt.Sprintf("listxattr(P(%q), buf, %d)", op.pathname, op.rbuf), int64(op.refn), op.referr)
+		case operRemovexattr:
+			stmt = cExpect(fmt.Sprintf("removexattr(P(%q), %q)", op.pathname, op.xattr), 0, op.referr)
+		case operMuscleFlush:
+			stmt = fmt.Sprintf("expectfail(\"flush\", ctl(\"flush\\n\"), %d);", cBool(op.suterr != nil))
+		case operMusclePush:
+			stmt = fmt.Sprintf("expectfail(\"push\", ctl(\"push\\n\"), %d);", cBool(op.suterr != nil))
+		case operMuscleTrim:
+			stmt = fmt.Sprintf("expectfail(\"trim\", ctl(\"trim\\n\"), %d);", cBool(op.suterr != nil))
+		case operMuscleRemount, operSwapClients:
+			b.WriteString("\t// Not reproducible, closing all files as fsdiff does.\n")
+			closeAll()
+		case operMusclePruneCache:
+			b.WriteString("\t// Not reproducible.\n")
+		case operMuscleCrash:
+			b.WriteString("\t// Not reproducible, musclefs was killed and restarted here; the expected results\n\t// that follow are against the tree as of the last flush, push or sync.\n")
+			// Files are opened again as fsdiff does, expected to fail
+			// where they no longer existed on the reference.
+			reopen := reopenable(seq.openOpers)
+			closeAll()
+			reopened := make(map[*oper]bool)
+			for _, f := range op.reopened {
+				reopened[f] = true
+			}
+			for _, f := range reopen {
+				call := fmt.Sprintf("open(P(%q), %#o)", f.pathname, reopenFlags(f))
+				if reopened[f] {
+					b.WriteString("\t" + cExpectFd(cFd(f), call, nil) + "\n")
+					seq.openOpers = append(seq.openOpers, f)
+				} else {
+					_, _ = fmt.Fprintf(&b, "\t%s = %s;\n\texpectfail(%q, %s, 1);\n", cFd(f), call, call, cFd(f))
+				}
+			}
+		default:
+			return fmt.Errorf("writeCRepro: unknown op code: %v", op.code)
+		}
+		if stmt != "" {
+			b.WriteString("\t" + stmt + "\n")
+		}
+		seq.update(op)
+	}
+	b.WriteString(creproFooter)
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWriteCRepro(t *testing.T) {
+	open := &oper{id: 0, code: operOpen, pathname: "alfa", flags: syscall.O_RDWR}
+	gone := &oper{id: 1, code: operOpen, pathname: "bravo", flags: syscall.O_RDONLY}
+	write := &oper{id: 2, code: operWrite, parent: open, wbuf: []byte("hi"), refn: 2}
+	crash := &oper{id: 3, code: operMuscleCrash, reopened: []*oper{open}}
+	closeOp := &oper{id: 4, code: operClose, parent: open}
+	var b bytes.Buffer
+	if err := writeCRepro(&b, []*oper{open, gone, write, crash, closeOp}); err != nil {
+		t.Fatal(err)
+	}
+	c := b.String()
+	if !strings.HasPrefix(c, "/*\n") {
+		t.Errorf("got %q, want the program to start with a comment", c[:strings.Index(c, "\n")])
+	}
+	for _, want := range []string{
+		`int fd0 = openat(cwd, "alfa", 02 /* O_RDWR */, 00);`,
+		`expect("write(fd0, \"\\x68\\x69\", 2)", write(fd0, "\x68\x69", 2), 2, 0);`,
+		`expectfd("open(P(\"\"), O_RDONLY|O_DIRECTORY|O_CLOEXEC)", cwd, 0);`,
+		`expectfd("open(P(\"alfa\"), 02)", fd0, 0);`,
+		`expectfail("open(P(\"bravo\"), 0)", fd1, 1);`,
+		`expect("close(fd0)", close(fd0), 0, 0);`,
+	} {
+		if !strings.Contains(c, want) {
+			t.Errorf("got no %s in:\n%s", want, c)
+		}
+	}
+}
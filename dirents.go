@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The smallest buffer for getdents, enough for an entry with any of the
+// names in natoAlphabet, so that whether a call fails doesn't depend on
+// the order of the entries, which differs between file systems.
+const minDirentBuf = 32
+
+// A dirent is an entry as returned by getdents64(2).
+type dirent struct {
+	name string
+	// One of the DT_* constants, cf. readdir(3).
+	typ uint8
+}
+
+// Parses the entries filled in by getdents64(2), skipping "." and "..",
+// which not all file systems list, e.g., 9P servers.
+func parseDirents(b []byte) ([]dirent, error) {
+	nameOffset := int(unsafe.Offsetof(unix.Dirent{}.Name))
+	var entries []dirent
+	for len(b) > 0 {
+		if len(b) < nameOffset {
+			return nil, fmt.Errorf("parseDirents: short entry: %d bytes", len(b))
+		}
+		d := (*unix.Dirent)(unsafe.Pointer(&b[0]))
+		reclen := int(d.Reclen)
+		if reclen < nameOffset || reclen > len(b) {
+			return nil, fmt.Errorf("parseDirents: bad record length %d", reclen)
+		}
+		name := b[nameOffset:reclen]
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		if s := string(name); s != "." && s != ".." {
+			entries = append(entries, dirent{name: s, typ: d.Type})
+		}
+		b = b[reclen:]
+	}
+	return entries, nil
+}
+
+// The state of listing a directory through the file descriptors opened
+// by an operation, from the first getdents after opening them, or
+// seeking to the start, to the one after which both reached the end.
+type dirIter struct {
+	// Positions other than the start mean different things on
+	// different file systems, so there's nothing to check after
+	// seeking elsewhere.
+	skip bool
+
+	sut, ref         []dirent
+	sutDone, refDone bool
+	checked          bool
+
+	// The contents of the reference directory as of the last call,
+	// and the names created, removed or replaced since the first one,
+	// which may or may not be listed, see check.
+	last    map[string]direntState
+	changed map[string]bool
+}
+
+type direntState struct {
+	ino uint64
+	typ uint8
+}
+
+// Returns the listing in progress through the file descriptors opened
+// by the operation, or those they were duplicated from.
+func (op *oper) dirIter() *dirIter {
+	op = op.description()
+	if op.dir == nil {
+		op.dir = &dirIter{changed: make(map[string]bool)}
+	}
+	return op.dir
+}
+
+// Notes the contents of the reference directory before a call, if the
+// listing isn't over.
+func (it *dirIter) observe(reffd int) {
+	if it.skip || it.checked {
+		return
+	}
+	// Through a new file descriptor, so as not to move the one listed.
+	// Failing, e.g., because the directory was removed, means it's empty.
+	current := make(map[string]direntState)
+	if fd, err := unix.Openat(reffd, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0); err == nil {
+		f := os.NewFile(uintptr(fd), ".")
+		infos, _ := f.Readdir(-1)
+		_ = f.Close()
+		for _, info := range infos {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				// The DT_* constants are the S_IF* ones shifted.
+				current[info.Name()] = direntState{ino: st.Ino, typ: uint8(st.Mode & syscall.S_IFMT >> 12)}
+			}
+		}
+	}
+	if it.last != nil {
+		for name, s := range it.last {
+			if c, ok := current[name]; !ok || c != s {
+				it.changed[name] = true
+			}
+		}
+		for name := range current {
+			if _, ok := it.last[name]; !ok {
+				it.changed[name] = true
+			}
+		}
+	}
+	it.last = current
+}
+
+// Reports whether the listing started and isn't over.
+func (it *dirIter) inProgress() bool {
+	return it != nil && it.last != nil && !it.skip && !it.checked
+}
+
+// Marks the names the operation is about to create, remove or replace
+// as changed in the listings in progress of the directories they're
+// in: observe alone misses changes undone before the next call, e.g.,
+// renaming away and back, or removing and creating anew, reusing the
+// inode. Directories are told by inode, as they may have been renamed
+// since they were opened.
+func (seq *operSeq) touchListings(op *oper) {
+	switch op.code {
+	case operCreate, operOpen, operUnlink1, operUnlink2, operMkdir, operRmdir, operRename1,
+		operRename2, operRenameat2, operSymlink, operLink, operFlink:
+	default:
+		return
+	}
+	var listings []*dirIter
+	var fds []int
+	seq.mu.Lock()
+	for _, o := range seq.openOpers {
+		if it := o.description().dir; it.inProgress() {
+			listings = append(listings, it)
+			fds = append(fds, o.reffd)
+		}
+	}
+	seq.mu.Unlock()
+	for _, p := range []string{op.pathname, op.newpathname} {
+		if p == "" {
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Stat(filepath.Join(refDir, filepath.Dir(p)), &st); err != nil {
+			continue
+		}
+		for i, it := range listings {
+			var dst unix.Stat_t
+			if err := unix.Fstat(fds[i], &dst); err == nil && dst.Dev == st.Dev && dst.Ino == st.Ino {
+				it.changed[filepath.Base(p)] = true
+			}
+		}
+	}
+}
+
+// Adds the entries listed by the operation, and once both file systems
+// reached the end, checks them.
+func (it *dirIter) add(op *oper) error {
+	if it.skip || it.checked {
+		return nil
+	}
+	sut, err := parseDirents(op.sutbuf[:op.sutn])
+	if err != nil {
+		return fmt.Errorf("sut: %v", err)
+	}
+	ref, err := parseDirents(op.refbuf[:op.refn])
+	if err != nil {
+		return fmt.Errorf("ref: %v", err)
+	}
+	it.sut = append(it.sut, sut...)
+	it.ref = append(it.ref, ref...)
+	it.sutDone = it.sutDone || op.sutn == 0
+	it.refDone = it.refDone || op.refn == 0
+	if !it.sutDone || !it.refDone {
+		return nil
+	}
+	it.checked = true
+	if err := it.check(it.sut); err != nil {
+		return fmt.Errorf("sut: %v", err)
+	}
+	if err := it.check(it.ref); err != nil {
+		return fmt.Errorf("ref: %v", err)
+	}
+	return nil
+}
+
+// Checks the entries listed against the reference directory: those not
+// changed during the listing must have been listed exactly once, with
+// the right type, or DT_UNKNOWN, which any file system may return, and
+// no others. Whether those changed were is unspecified, cf. readdir(3).
+func (it *dirIter) check(entries []dirent) error {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		if it.changed[e.name] {
+			continue
+		}
+		want, ok := it.last[e.name]
+		if !ok {
+			return fmt.Errorf("unexpected entry %q", e.name)
+		}
+		if e.typ != unix.DT_UNKNOWN && e.typ != want.typ {
+			return fmt.Errorf("entry %q: type %d, want %d", e.name, e.typ, want.typ)
+		}
+		counts[e.name]++
+	}
+	var names []string
+	for name := range it.last {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !it.changed[name] && counts[name] != 1 {
+			return fmt.Errorf("entry %q listed %d times", name, counts[name])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDirIterCheckAcceptsUnknownType(t *testing.T) {
+	it := &dirIter{
+		last:    map[string]direntState{"alfa": {ino: 1, typ: unix.DT_REG}},
+		changed: make(map[string]bool),
+	}
+	if err := it.check([]dirent{{name: "alfa", typ: unix.DT_UNKNOWN}}); err != nil {
+		t.Errorf("got %v, want nil for DT_UNKNOWN", err)
+	}
+	if err := it.check([]dirent{{name: "alfa", typ: unix.DT_DIR}}); err == nil {
+		t.Error("got nil, want an error for the wrong type")
+	}
+}
+
+func TestTouchListingsMarksNamesInListedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsdiff-dirents-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	saved := refDir
+	refDir = dir
+	defer func() {
+		refDir = saved
+	}()
+	if err := os.Mkdir(filepath.Join(dir, "alfa"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Open(filepath.Join(dir, "alfa"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+	open := &oper{code: operOpen, pathname: "alfa", reffd: fd}
+	open.dirIter().observe(fd)
+	seq := &operSeq{openOpers: []*oper{open}}
+	seq.touchListings(&oper{code: operRename1, pathname: "alfa/bravo", newpathname: "charlie"})
+	if !open.dir.changed["bravo"] {
+		t.Error("got bravo unchanged, want it changed after renaming it away")
+	}
+	if open.dir.changed["charlie"] {
+		t.Error("got charlie changed, outside of the listed directory")
+	}
+	seq.touchListings(&oper{code: operLstat, pathname: "alfa/delta"})
+	if open.dir.changed["delta"] {
+		t.Error("got delta changed by lstat")
+	}
+}
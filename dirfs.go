@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// A dirfs is an already mounted file system, e.g., a FUSE file system or
+// a bind mount, tested through a new directory within it. It has none
+// of the optional capabilities of a sut, so only POSIX operations run.
+type dirfs struct {
+	path string
+}
+
+func newDirFS(parent string) (*dirfs, error) {
+	// The reference file system starts empty, so must the tested one.
+	path, err := ioutil.TempDir(parent, "fsdiff-*")
+	if err != nil {
+		return nil, fmt.Errorf("newDirFS: %v", err)
+	}
+	return &dirfs{path: path}, nil
+}
+
+func (fs *dirfs) start() error {
+	return nil
+}
+
+func (fs *dirfs) stop() error {
+	return nil
+}
+
+func (fs *dirfs) mount() error {
+	return nil
+}
+
+func (fs *dirfs) unmount() error {
+	return nil
+}
+
+func (fs *dirfs) mountpoint() string {
+	return fs.path
+}
+
+func (fs *dirfs) close() error {
+	return nil
+}
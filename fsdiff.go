@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -25,20 +26,48 @@ var (
 	// namely, its subtree rooted at the temporary directory refDir.
 	refDir string
 
-	// The current system under test is filesystems[sut].
-	// There are two instances to test push (from one) and pull (from the other).
-	filesystems [2]*musclefs
+	// The current system under test is filesystems[suti].
+	// There may be two instances to test push (from one) and pull (from the other).
+	filesystems [2]sut
 	suti        int
 
+	// Whether to log the 9P messages exchanged with the systems under test.
+	traceWire bool
+
+	// Whether tree descriptions include extended attributes, along with
+	// other metadata, see describeXattrs.
+	hashXattrs bool
+
+	// The file mode creation mask of the process, set explicitly so that
+	// runs are reproducible.
+	umask uint32 = 022
+
+	// When the run started; timestamps from before are those set
+	// explicitly, cf. describeTime.
+	runStart time.Time
+
+	// Timestamps match if they do when truncated to this, see config.
+	timeGranularity = time.Second
+
+	// Errors the system under test may fail with, by operation, see
+	// config.
+	expectedErrors map[operKind][]syscall.Errno
+	// Those of seeks to data or holes, rather than expectedErrors.
+	expectedHoleErrors []syscall.Errno
+
+	// The block size musclefs is started with, see sizeConfig.
+	blockSize = defaultSizes.BlockSize
+
+	// The options musclefs is mounted with, see config.
+	mountOptions string
+
 	// Summary of the contents of the fs after the last successful comparison between
 	// reference file system and file system under test.
 	lastTreeDescription []byte
 )
 
-// Linux mode bits.
-var _ uint32 = 0777 | syscall.S_ISGID | syscall.S_ISUID | syscall.S_ISVTX
-
-func beforeAll() (err error) {
+func beforeAll(spec string) (err error) {
+	runStart = time.Now()
 	testDir, err = ioutil.TempDir("", "fsdiff-*")
 	if err != nil {
 		return fmt.Errorf("beforeAll: %v", err)
@@ -47,16 +76,14 @@ func beforeAll() (err error) {
 	if err = os.Mkdir(refDir, 0700); err != nil {
 		return fmt.Errorf("beforeAll: %v", err)
 	}
-	encryptionKey := make([]byte, 16)
-	rand.Read(encryptionKey)
-	if filesystems[0], err = newMuscleFS(testDir, filepath.Join(testDir, "sut0"), encryptionKey); err != nil {
-		return fmt.Errorf("beforeAll: %v", err)
-	}
-	if filesystems[1], err = newMuscleFS(testDir, filepath.Join(testDir, "sut1"), encryptionKey); err != nil {
+	if filesystems, err = newSUTs(spec, traceWire); err != nil {
 		return fmt.Errorf("beforeAll: %v", err)
 	}
 
 	for _, fs := range filesystems {
+		if fs == nil {
+			continue
+		}
 		if err := fs.start(); err != nil {
 			return fmt.Errorf("beforeAll: %v", err)
 		}
@@ -71,33 +98,64 @@ func beforeAll() (err error) {
 
 func afterAll() {
 	for _, fs := range filesystems {
+		if fs == nil {
+			continue
+		}
 		if err := fs.unmount(); err != nil {
 			logWarn("afterAll: %v", err)
 		}
 		if err := fs.stop(); err != nil {
 			logWarn("afterAll: %v", err)
 		}
-		_ = fs.stdout.Close()
-		_ = fs.stderr.Close()
+		if err := fs.close(); err != nil {
+			logWarn("afterAll: %v", err)
+		}
 	}
 }
 
 // Main loop for random sequential operation sequences.
-func runOperations(max int, periods hashPeriods, cfg *config) error {
-	seq := operSeq{
-		maxOpers:      int32(max),
-		ranges:        cfg.probabilityRanges(),
-		existingDirs:  make(map[string]struct{}),
-		existingFiles: make(map[string]struct{}),
-		sutcwd:        -1,
-		refcwd:        -1,
+// If replay is not nil, its operations are run instead of random ones.
+func runOperations(max int, seed int64, periods hashPeriods, cfg *config, replay []*oper) (err error) {
+	if replay != nil {
+		max = len(replay)
+	}
+	if err := cfg.restrict(filesystems); err != nil {
+		return fmt.Errorf("runOperations: %v", err)
+	}
+	seq := newOperSeq(max, cfg, seed)
+	seq.replay = replay
+	// Keeping track of what must survive a crash takes copying and
+	// hashing, not worth it with no crashes to come.
+	if cfg.probabilities[operMuscleCrash] > 0 || crashes(replay) {
+		seq.durableDir = filepath.Join(testDir, "durable")
+		if err := seq.saveDurable(); err != nil {
+			return fmt.Errorf("runOperations: %v", err)
+		}
 	}
 	logInfo("ranges: %v", seq.ranges)
+	tracePath := filepath.Join(testDir, "trace.jsonl")
+	trace, err := newTraceWriter(tracePath)
+	if err != nil {
+		return fmt.Errorf("runOperations: %v", err)
+	}
+	logInfo("runOperations: recording operations to %s", tracePath)
+	seq.trace = trace
+	defer func() {
+		if err := trace.close(); err != nil {
+			logWarn("runOperations: %v", err)
+		}
+	}()
 	defer func() {
 		if err := seq.closeAll(); err != nil {
 			logWarn("runOperations: %v", err)
 		}
 	}()
+	// Before closing all files, which adds to the wire trace.
+	defer func() {
+		if err != nil {
+			logWireTraceTail()
+		}
+	}()
 	for {
 		if seq.sutcwd == -1 || seq.refcwd == -1 {
 			if err := seq.opencwds(); err != nil {
@@ -109,25 +167,41 @@ func runOperations(max int, periods hashPeriods, cfg *config) error {
 			return nil
 		}
 		if err := seq.run(op); err != nil {
-			return fmt.Errorf("runOperations: %v", err)
+			return fmt.Errorf("runOperations: %w", err)
 		}
-		sutDesc, err := hashTree(filesystems[suti].mnt, op.id%periods.hashMetadata == 0, op.id%periods.hashContents == 0)
+		includeMeta, includeContent, includeTimes := periods.at(op.id)
+		sutDesc, err := hashSUT(filesystems[suti], includeMeta, includeContent, includeTimes)
 		if err != nil {
 			return fmt.Errorf("runOperations: %v", err)
 		}
-		refDesc, err := hashTree(refDir, op.id%periods.hashMetadata == 0, op.id%periods.hashContents == 0)
+		refDesc, err := hashTree(refDir, includeMeta, includeContent, includeTimes)
 		if err != nil {
 			return fmt.Errorf("runOperations: %v", err)
 		}
 		if diff := cmp.Diff(sutDesc, refDesc); diff != "" {
 			logError("Tree difference between fs under test and reference fs: %s", diff)
 			logError("Tree difference between fs under test and previous description of fs under test: %s", cmp.Diff(sutDesc, lastTreeDescription))
-			return fmt.Errorf("runOperations: hashes do not match")
+			return fmt.Errorf("runOperations: %w", op.mismatch("tree", "hashes do not match"))
 		}
 		lastTreeDescription = sutDesc
 	}
 }
 
+// Logs the last 9P messages exchanged with the current system under
+// test, if recorded, to help diagnose a failure.
+func logWireTraceTail() {
+	t, ok := filesystems[suti].(wireTracer)
+	if !ok || t.wireTrace() == "" {
+		return
+	}
+	lines, err := tailLines(t.wireTrace(), 50)
+	if err != nil {
+		logWarn("logWireTraceTail: %v", err)
+		return
+	}
+	logError("Last 9P messages, from %s:\n%s", t.wireTrace(), strings.Join(lines, "\n"))
+}
+
 func main() {
 	_ = agent.Listen(agent.Options{})
 	configPath := flag.String("c", "", "`path` to configuration")
@@ -135,13 +209,28 @@ func main() {
 	max := flag.Int("m", 100, "max number of operations")
 	seed := flag.Int64("seed", time.Now().UnixNano(), "")
 	periods := hashPeriods{hashMetadata: 1, hashContents: 250}
-	flag.CommandLine.Var(&periods, "periods", "how often to compare fs hashes")
+	flag.CommandLine.Var(&periods, "periods", "how often to compare fs hashes: `metadata,contents[,timestamps]`")
+	sutSpec := flag.String("sut", "musclefs", "the file system to test, musclefs, 9p (musclefs without the kernel 9p driver) or dir:`path`")
 	shell := flag.Bool("shell", false, "run a shell instead of random operations")
+	replayPath := flag.String("replay", "", "run the operations from the trace at `path` instead of random ones")
+	shrinkPath := flag.String("shrink", "", "minimize the failing operations from the trace at `path`")
+	selfCheck := flag.Bool("selfcheck", false, "generate operations twice, without running them, and check they are the same")
+	flag.BoolVar(&traceWire, "wiretrace", false, "log 9P messages between the kernel, or the 9P client, and musclefs")
+	flag.BoolVar(&hashXattrs, "xattrs", false, "compare extended attributes when comparing metadata")
+	umaskFlag := flag.String("umask", fmt.Sprintf("%03o", umask), "file mode creation `mask`, in octal")
+	workers := flag.Int("workers", 1, "run operations from `n` concurrent workers, checking linearizability, if more than 1")
+	creproPath := flag.String("crepro", "", "write a C reproducer for the operations from the trace at `path`")
 	flag.Parse()
 	if flag.NArg() != 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	m, err := strconv.ParseUint(*umaskFlag, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		logFatal("fsdiff: bad umask %q", *umaskFlag)
+	}
+	umask = uint32(m)
+	syscall.Umask(int(umask))
 
 	var cfg *config
 	if *configPath != "" {
@@ -160,16 +249,65 @@ func main() {
 	} else {
 		cfg, _ = loadConfig(strings.NewReader("{}"))
 	}
+	timeGranularity = cfg.timeGranularity
+	expectedErrors = cfg.expectedErrors
+	expectedHoleErrors = cfg.expectedHoleErrors
+	blockSize = cfg.Sizes.BlockSize
+	mountOptions = cfg.MountOptions
 
 	logInfo("Setting seed=%d", *seed)
-	rand.Seed(*seed)
 
 	if *randomProbabilities {
-		cfg.randomizeProbabilities()
+		cfg.randomizeProbabilities(rand.New(rand.NewSource(*seed)))
 		logInfo(cfg.String())
 	}
 
-	if err := beforeAll(); err != nil {
+	if *selfCheck {
+		if err := checkDeterminism(*max, *seed, cfg); err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		logInfo("fsdiff: generated the same %d operations twice", *max)
+		return
+	}
+
+	var replay []*oper
+	if *replayPath != "" {
+		ops, err := loadTrace(*replayPath)
+		if err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		replay = cloneOpers(ops)
+	}
+
+	if *creproPath != "" {
+		ops, err := loadTrace(*creproPath)
+		if err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		if err := writeCRepro(os.Stdout, ops); err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		return
+	}
+
+	if *shrinkPath != "" {
+		ops, err := loadTrace(*shrinkPath)
+		if err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		ops, err = shrink(ops, *sutSpec, periods, cfg)
+		if err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		minPath := *shrinkPath + ".min"
+		if err := writeTrace(minPath, ops); err != nil {
+			logFatal("fsdiff: %v", err)
+		}
+		logInfo("fsdiff: wrote %d operations to %s", len(ops), minPath)
+		return
+	}
+
+	if err := beforeAll(*sutSpec); err != nil {
 		logFatal("fsdiff: %v", err)
 	}
 	if *shell {
@@ -181,8 +319,14 @@ func main() {
 		if err := cmd.Run(); err != nil {
 			logError("fsdiff: %v", err)
 		}
+	} else if *workers > 1 {
+		if err := runConcurrent(*max, *workers, *seed, cfg); err != nil {
+			logError("fsdiff: %v", err)
+			afterAll()
+			os.Exit(1)
+		}
 	} else {
-		if err := runOperations(*max, periods, cfg); err != nil {
+		if err := runOperations(*max, *seed, periods, cfg, replay); err != nil {
 			logError("fsdiff: %v", err)
 			afterAll()
 			os.Exit(1)
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Holes are checked to read as zeros up to this many bytes into them,
+// as files can have gigabytes of holes, cf. sizeConfig.MaxSparseOffset.
+const maxHoleCheck = 1 << 20
+
+func seeksHoles(whence int) bool {
+	return whence == seekData || whence == seekHole
+}
+
+// Checks seeking to data or a hole, having succeeded on both file
+// systems, against the contents of the file on each, rather than
+// against the other file system: where holes are depends on how each
+// allocates files, and on whether it keeps track of holes at all. Both
+// being right, the sut goes on from where the reference does. Failing
+// on one file system only is up to the expected errors, see
+// oper.expectedErrnos.
+func (op *oper) checkHoles() error {
+	if op.referr != nil {
+		return nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(op.parent.reffd, &st); err != nil {
+		return fmt.Errorf("oper.checkHoles: %v", err)
+	}
+	// Directories have neither data nor holes, and file systems make up
+	// different answers, e.g., ext4 puts the end of hashed directories
+	// at the largest offset.
+	if st.Mode&unix.S_IFMT == unix.S_IFREG {
+		if err := holesHold(sutClient(), op.parent.sutfd, op.whence, op.offset, op.sutoff, op.suterr); err != nil {
+			return op.mismatch("holes", "seek: sut: %v", err)
+		}
+		if err := holesHold(kernelClient{}, op.parent.reffd, op.whence, op.offset, op.refoff, op.referr); err != nil {
+			return op.mismatch("holes", "seek: ref: %v", err)
+		}
+	}
+	if op.sutoff != op.refoff {
+		logWarn("oper.checkHoles: sut at %d, ref at %d, moving the sut along", op.sutoff, op.refoff)
+		if _, err := sutClient().seek(op.parent.sutfd, op.refoff, io.SeekStart); err != nil {
+			return fmt.Errorf("oper.checkHoles: %v", err)
+		}
+	}
+	return nil
+}
+
+// Checks the outcome of seeking to data or a hole from the offset, on
+// one of the file systems: there's neither past the end of the file,
+// and what's skipped to get to data, or the hole found, must read as
+// zeros.
+func holesHold(c sysClient, fd int, whence int, offset int64, result int64, err error) error {
+	var st unix.Stat_t
+	if err := c.fstat(fd, &st); err != nil {
+		return err
+	}
+	size := st.Size
+	if offset < 0 || offset >= size {
+		if err != syscall.ENXIO {
+			return fmt.Errorf("got %d (%v) from %d past the end at %d, want ENXIO", result, err, offset, size)
+		}
+		return nil
+	}
+	start, end := offset, result
+	switch {
+	case whence == seekData && err == syscall.ENXIO:
+		// Holes only, up to the end.
+		end = size
+	case err != nil:
+		return err
+	case result < offset || result > size || (whence == seekData && result == size):
+		return fmt.Errorf("got %d from %d, with the end at %d", result, offset, size)
+	case whence == seekHole:
+		// The hole goes on up to the next data, if any, which is looked
+		// for without moving the offset.
+		start, end = result, size
+		cur, err := c.seek(fd, 0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		data, err := c.seek(fd, result, seekData)
+		if err == nil {
+			end = data
+		}
+		if _, err := c.seek(fd, cur, io.SeekStart); err != nil {
+			return err
+		}
+		if end == start && start < size {
+			return fmt.Errorf("got %d from %d, where there's data", result, offset)
+		}
+	}
+	return readsZeros(c, fd, start, end)
+}
+
+// Checks the range punched by fallocate reads as zeros on both file
+// systems.
+func (op *oper) checkPunched() error {
+	end := op.offset + int64(op.length)
+	if err := readsZeros(sutClient(), op.parent.sutfd, op.offset, end); err != nil {
+		return fmt.Errorf("sut: %v", err)
+	}
+	if err := readsZeros(kernelClient{}, op.parent.reffd, op.offset, end); err != nil {
+		return fmt.Errorf("ref: %v", err)
+	}
+	return nil
+}
+
+// Checks the file reads as zeros from start to end, or its end if it
+// comes first, up to maxHoleCheck bytes, unless it isn't open for
+// reading.
+func readsZeros(c sysClient, fd int, start, end int64) error {
+	if end > start+maxHoleCheck {
+		end = start + maxHoleCheck
+	}
+	b := make([]byte, 64<<10)
+	for off := start; off < end; {
+		if n := end - off; n < int64(len(b)) {
+			b = b[:n]
+		}
+		n, err := c.pread(fd, b, off)
+		if err == syscall.EBADF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		for i, x := range b[:n] {
+			if x != 0 {
+				return fmt.Errorf("byte at %d is %#x, want 0 in a hole", off+int64(i), x)
+			}
+		}
+		off += int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestHolesHoldAfterPunchingOne(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsdiff-holes-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	fd := int(f.Fd())
+	if _, err := f.Write(make([]byte, 4*pageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("x"), 4*pageSize-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, pageSize, pageSize); err != nil {
+		t.Skip(err)
+	}
+	c := kernelClient{}
+	for _, whence := range []int{seekData, seekHole} {
+		for _, offset := range []int64{0, pageSize, 4*pageSize - 1, 4 * pageSize} {
+			result, err := c.seek(fd, offset, whence)
+			if err := holesHold(c, fd, whence, offset, result, err); err != nil {
+				t.Errorf("whence %d, offset %d: %v", whence, offset, err)
+			}
+		}
+	}
+	// Zeros can't be told from holes, but data can.
+	if err := holesHold(c, fd, seekData, 0, 4*pageSize-1, nil); err != nil {
+		t.Errorf("got %v, want nil for zeros skipped", err)
+	}
+	if err := holesHold(c, fd, seekHole, 0, 4*pageSize-1, nil); err == nil {
+		t.Error("got nil for a hole at the last byte")
+	}
+	if err := holesHold(c, fd, seekData, 4*pageSize, 4*pageSize, nil); err == nil {
+		t.Error("got nil for data past the end")
+	}
+	if err := holesHold(c, fd, seekData, 0, -1, syscall.ENXIO); err == nil {
+		t.Error("got nil for no data before the last byte")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mappings are shared, so that what is written through them ends up in
+// the file, and readable and writable, which needs files open O_RDWR.
+const mmapProt = unix.PROT_READ | unix.PROT_WRITE
+
+// Mappings start at offsets multiple of this, or fail.
+var pageSize = int64(os.Getpagesize())
+
+// Copies through a mapping, failing with EFAULT where a load or store
+// would fault, rather than crashing, e.g., with SIGBUS for pages past
+// the end of the file. Bytes are copied one at a time, in order, so
+// that what is copied before a fault is the same on both file systems,
+// and in the C reproducer, cf. copy.
+func mcopy(dst, src []byte) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); !ok {
+				panic(r)
+			}
+			n, err = 0, syscall.EFAULT
+		}
+	}()
+	for n < len(dst) && n < len(src) {
+		dst[n] = src[n]
+		n++
+	}
+	return n, nil
+}
+
+// Reads len(p) bytes from the mapping, at the offset within it. Bytes
+// outside of the mapping fault, as they would for a program.
+func mread(m []byte, offset int64, p []byte) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > int64(len(m)) {
+		return 0, syscall.EFAULT
+	}
+	return mcopy(p, m[offset:])
+}
+
+// Writes p to the mapping, at the offset within it, cf. mread.
+func mwrite(m []byte, offset int64, p []byte) (int, error) {
+	if offset < 0 || offset+int64(len(p)) > int64(len(m)) {
+		return 0, syscall.EFAULT
+	}
+	return mcopy(m[offset:], p)
+}
+
+// Returns how many of n bytes from the offset within the mapping of the
+// mmap operation to write so as not to go past the end of the file, on
+// the reference file system: what's written to the rest of the last
+// page is unspecified, and may or may not end up in the file once it's
+// extended. Writes starting in later pages fault anyway. Mappings not
+// made, as when only generating operations, are left alone.
+func mappedLength(m *oper, offset int64, n int) int {
+	var st unix.Stat_t
+	if err := unix.Fstat(m.refmapfd, &st); err != nil {
+		return n
+	}
+	start, end := m.offset+offset, m.offset+offset+int64(n)
+	switch {
+	case end <= st.Size:
+		return n
+	case start < st.Size:
+		return int(st.Size - start)
+	case start < (st.Size+pageSize-1)/pageSize*pageSize:
+		return 0
+	default:
+		return n
+	}
+}
+
+// Unmaps all mappings, on both file systems. The sut ones may belong
+// to a killed instance, so errors unmapping them are expected.
+func (seq *operSeq) unmapAll() error {
+	for _, m := range seq.mappedOpers {
+		if err := unix.Munmap(m.sutmap); err != nil {
+			logDebug("operSeq.unmapAll: %v", err)
+		}
+		if err := unix.Munmap(m.refmap); err != nil {
+			return fmt.Errorf("operSeq.unmapAll: %v", err)
+		}
+		_ = unix.Close(m.refmapfd)
+	}
+	seq.mappedOpers = nil
+	return nil
+}
+
+// Checks that the mappings of the file the operation has file
+// descriptors open on read the same as the file through them, on each
+// file system: writes through either must show through the other, as
+// mappings are shared, e.g., after write(2), ftruncate(2), or a write
+// through a mapping, and msync(2).
+func (seq *operSeq) checkMappings(fds *oper) error {
+	seq.mu.Lock()
+	mapped := append([]*oper(nil), seq.mappedOpers...)
+	seq.mu.Unlock()
+	if len(mapped) == 0 {
+		return nil
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(fds.reffd, &st); err != nil {
+		return err
+	}
+	for _, m := range mapped {
+		var mst unix.Stat_t
+		if err := unix.Fstat(m.refmapfd, &mst); err != nil {
+			return err
+		}
+		if mst.Dev != st.Dev || mst.Ino != st.Ino {
+			continue
+		}
+		if err := coherent(fds.sutfd, m.sutmap, m.offset); err != nil {
+			return fmt.Errorf("sut: mapping %d: %v", m.id, err)
+		}
+		if err := coherent(fds.reffd, m.refmap, m.offset); err != nil {
+			return fmt.Errorf("ref: mapping %d: %v", m.id, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether the operation has file descriptors open.
+func (seq *operSeq) isOpen(op *oper) bool {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	for _, o := range seq.openOpers {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares the mapping with the file it maps, from the offset, up to
+// the end of either, unless the file isn't open for reading.
+func coherent(fd int, m []byte, offset int64) error {
+	b := make([]byte, len(m))
+	n, err := unix.Pread(fd, b, offset)
+	if err == unix.EBADF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mapped := make([]byte, n)
+	if _, err := mcopy(mapped, m); err != nil {
+		return err
+	}
+	for i := range mapped {
+		if mapped[i] != b[i] {
+			return fmt.Errorf("offset %d: mapped %#x, read %#x", offset+int64(i), mapped[i], b[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMappingFaultsPastEndOfFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsdiff-mmap-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := unix.Mmap(int(f.Fd()), 0, int(2*pageSize), mmapProt, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = unix.Munmap(m)
+	}()
+	// The rest of the last page reads as zeros, the next faults.
+	p := make([]byte, pageSize)
+	if n, err := mread(m, 0, p); n != len(p) || err != nil || p[0] != 'x' || p[1] != 0 {
+		t.Errorf("got %d, %v, %q, want %d, nil, \"x\\x00\"", n, err, p[:2], len(p))
+	}
+	if _, err := mread(m, pageSize, p[:1]); err != syscall.EFAULT {
+		t.Errorf("got %v, want EFAULT", err)
+	}
+	// What precedes the fault is written.
+	if _, err := mwrite(m, pageSize-1, []byte("yz")); err != syscall.EFAULT {
+		t.Errorf("got %v, want EFAULT", err)
+	}
+	if m[pageSize-1] != 'y' {
+		t.Errorf("got %q, want 'y'", m[pageSize-1])
+	}
+	if _, err := mread(m, 2*pageSize-1, p[:2]); err != syscall.EFAULT {
+		t.Errorf("got %v, want EFAULT outside of the mapping", err)
+	}
+}
+
+func TestMappedLengthStopsAtEndOfFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "fsdiff-mmap-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if err := f.Truncate(pageSize + 10); err != nil {
+		t.Fatal(err)
+	}
+	m := &oper{code: operMmap, offset: pageSize, refmapfd: int(f.Fd())}
+	for _, c := range []struct {
+		offset int64
+		n      int
+		want   int
+	}{
+		{0, 5, 5},
+		{5, 20, 5},
+		{10, 5, 0},
+		{pageSize - 1, 2, 0},
+		{pageSize, 5, 5},
+	} {
+		if got := mappedLength(m, c.offset, c.n); got != c.want {
+			t.Errorf("offset %d, length %d: got %d, want %d", c.offset, c.n, got, c.want)
+		}
+	}
+	m.refmapfd = -1
+	if got := mappedLength(m, 10, 5); got != 5 {
+		t.Errorf("got %d, want 5 for a mapping not made", got)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	crand "crypto/rand"
 	"errors"
 	"fmt"
 	"io"
@@ -32,9 +34,22 @@ type musclefs struct {
 	cmd    *exec.Cmd
 	stdout *os.File
 	stderr *os.File
+
+	// If not nil, 9P clients connect through it, and their messages are
+	// logged to wireLog.
+	proxy   *ninepProxy
+	wireLog string
 }
 
-func newMuscleFS(testDir string, sutDir string, encryptionKey []byte) (*musclefs, error) {
+func newEncryptionKey() ([]byte, error) {
+	encryptionKey := make([]byte, 16)
+	if _, err := crand.Read(encryptionKey); err != nil {
+		return nil, err
+	}
+	return encryptionKey, nil
+}
+
+func newMuscleFS(testDir string, sutDir string, encryptionKey []byte, traceWire bool) (*musclefs, error) {
 	if err := os.Mkdir(sutDir, 0700); err != nil {
 		return nil, err
 	}
@@ -76,7 +91,7 @@ musclefs-mount %s
 		_ = suterr.Close()
 		return nil, err
 	}
-	return &musclefs{
+	fs := &musclefs{
 		base:           sutDir,
 		cache:          filepath.Join(sutDir, "cache"),
 		ctl:            filepath.Join(sutDir, "mnt", "ctl"),
@@ -86,11 +101,29 @@ musclefs-mount %s
 		staging:        filepath.Join(sutDir, "staging"),
 		stdout:         sutout,
 		stderr:         suterr,
-	}, nil
+	}
+	if traceWire {
+		fs.wireLog = filepath.Join(sutDir, "wire.log")
+		fs.proxy, err = startNinepProxy(filepath.Join(sutDir, "proxy.sock"), socket, fs.wireLog)
+		if err != nil {
+			_ = sutout.Close()
+			_ = suterr.Close()
+			return nil, fmt.Errorf("newMuscleFS: %v", err)
+		}
+	}
+	return fs, nil
+}
+
+// Returns the socket 9P clients should connect to.
+func (fs *musclefs) clientSocket() string {
+	if fs.proxy != nil {
+		return fs.proxy.listener.Addr().String()
+	}
+	return fs.socket
 }
 
 func (fs *musclefs) start() error {
-	cmd := exec.Command("musclefs", "-D", "-fsdiff.blocksize=8192")
+	cmd := exec.Command("musclefs", "-D", fmt.Sprintf("-fsdiff.blocksize=%d", blockSize))
 	cmd.Stdout = fs.stdout
 	cmd.Stderr = fs.stderr
 	cmd.Dir = fs.base
@@ -128,9 +161,13 @@ func (fs *musclefs) stop() error {
 func (fs *musclefs) mount() error {
 	uid := os.Getuid()
 	gid := os.Getgid()
-	socket := filepath.Join(fs.base, "muscle.sock")
+	socket := fs.clientSocket()
 	mountPoint := filepath.Join(fs.base, "mnt")
-	cmd := exec.Command("sudo", "mount", "-t", "9p", socket, mountPoint, "-o", fmt.Sprintf("trans=unix,dfltuid=%d,dfltgid=%d", uid, gid))
+	options := fmt.Sprintf("trans=unix,dfltuid=%d,dfltgid=%d", uid, gid)
+	if mountOptions != "" {
+		options += "," + mountOptions
+	}
+	cmd := exec.Command("sudo", "mount", "-t", "9p", socket, mountPoint, "-o", options)
 	combinedOutput, err := cmd.CombinedOutput()
 	if err != nil {
 		logInfo("musclefs.mount: %s", string(combinedOutput))
@@ -157,10 +194,28 @@ func (fs *musclefs) unmount() error {
 	return nil
 }
 
-func (fs *musclefs) restart(s *operSeq) error {
-	if err := s.closeAll(); err != nil {
-		return fmt.Errorf("musclefs.restart: %v", err)
+func (fs *musclefs) mountpoint() string {
+	return fs.mnt
+}
+
+func (fs *musclefs) close() error {
+	err := fs.stdout.Close()
+	if err2 := fs.stderr.Close(); err == nil {
+		err = err2
 	}
+	if fs.proxy != nil {
+		if err2 := fs.proxy.close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+func (fs *musclefs) wireTrace() string {
+	return fs.wireLog
+}
+
+func (fs *musclefs) restart() error {
 	if err := fs.unmount(); err != nil {
 		return fmt.Errorf("musclefs.restart: %v", err)
 	}
@@ -176,6 +231,87 @@ func (fs *musclefs) restart(s *operSeq) error {
 	return nil
 }
 
+// Kills musclefs, which can't save anything then.
+func (fs *musclefs) kill() error {
+	if err := fs.cmd.Process.Kill(); err != nil {
+		return fmt.Errorf("musclefs.kill: could not kill %d: %v", fs.cmd.Process.Pid, err)
+	}
+	// The error only tells it was killed.
+	_ = fs.cmd.Wait()
+	return nil
+}
+
+// Detaches the mount of the killed musclefs, then starts and mounts it
+// again, with the state it left on disk.
+func (fs *musclefs) recoverFromKill() error {
+	umount := exec.Command("sudo", "umount", "-l", fs.mnt)
+	if combinedOutput, err := umount.CombinedOutput(); err != nil {
+		logInfo("musclefs.recoverFromKill: %s", string(combinedOutput))
+		return fmt.Errorf("musclefs.recoverFromKill: %v", err)
+	}
+	if err := fs.start(); err != nil {
+		return fmt.Errorf("musclefs.recoverFromKill: %v", err)
+	}
+	if err := fs.mount(); err != nil {
+		return fmt.Errorf("musclefs.recoverFromKill: %v", err)
+	}
+	return nil
+}
+
+func (fs *musclefs) flush() error {
+	_, err := fs.runCommand("flush\n")
+	return err
+}
+
+func (fs *musclefs) push() error {
+	_, err := fs.runCommand("push\n")
+	return err
+}
+
+// Checks that the staging area is empty.
+func (fs *musclefs) pushed() error {
+	check := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("found file: %v", path)
+		}
+		return nil
+	}
+	return filepath.Walk(fs.staging, check)
+}
+
+func (fs *musclefs) pull() error {
+	return pullWorklog(fs)
+}
+
+// Pulls, and runs the commands from the resulting worklog.
+func pullWorklog(c commander) error {
+	worklog, err := c.runCommand("pull\n")
+	if err != nil {
+		return fmt.Errorf("pullWorklog: %v", err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(worklog))
+	for s.Scan() {
+		command := s.Text()
+		logDebug("pullWorklog: got pull command %q", command)
+		switch {
+		case command[0] == '#':
+			// Ignore comment.
+		case strings.HasPrefix(command, "graft2 "), strings.HasPrefix(command, "unlink "), command == "flush", command == "pull":
+			if _, err := c.runCommand(command + "\n"); err != nil {
+				return fmt.Errorf("pullWorklog: error running command %q from pull worklog: %v", command, err)
+			}
+		default:
+			return fmt.Errorf("pullWorklog: unexpected command from pull worklog: %q", command)
+		}
+	}
+	// No error from scanning a bytes.Reader.
+	_ = s.Err()
+	return nil
+}
+
 func (fs *musclefs) runCommand(cmd string) ([]byte, error) {
 	const maxResponseSize = 16384
 	f, err := os.OpenFile(fs.ctl, os.O_RDWR|os.O_CREATE, 0666)
@@ -0,0 +1,1257 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"golang.org/x/sys/unix"
+)
+
+// Maximum number of names in a single walk message.
+const maxWalkElements = 16
+
+// Error strings of 9P2000 servers, which don't send errno values,
+// mapped to what the Linux 9p driver would return.
+var ninepErrnos = map[string]syscall.Errno{
+	"file not found":            syscall.ENOENT,
+	"file already exists":       syscall.EEXIST,
+	"file exists":               syscall.EEXIST,
+	"permission denied":         syscall.EACCES,
+	"not a directory":           syscall.ENOTDIR,
+	"is a directory":            syscall.EISDIR,
+	"directory not empty":       syscall.ENOTEMPTY,
+	"file is a directory":       syscall.EISDIR,
+	"file in use":               syscall.EBUSY,
+	"bad offset in directory":   syscall.EINVAL,
+	"illegal mode":              syscall.EINVAL,
+	"unknown fid":               syscall.EBADF,
+	"fid already in use":        syscall.EBADF,
+	"file not open for reading": syscall.EBADF,
+	"file not open for writing": syscall.EBADF,
+}
+
+// Converts errors returned by the 9P client to errno values, where
+// possible, so they can be compared to those of the reference file system.
+func ninepError(err error) error {
+	var e *p.Error
+	if !errors.As(err, &e) {
+		return err
+	}
+	if e.Errornum != 0 {
+		return syscall.Errno(e.Errornum)
+	}
+	if errno, ok := ninepErrnos[e.Err]; ok {
+		return errno
+	}
+	return errorFromString(e.Err)
+}
+
+// A file descriptor of a ninepClient.
+type ninepFile struct {
+	// Open for I/O, unless the file is a directory: directory fids
+	// are only walked, so they can be walked from, like the cwd.
+	fid    *clnt.Fid
+	isDir  bool
+	flags  int
+	offset int64
+	// Whether the file was removed through this client since, so it
+	// has no links left, cf. fstat.
+	unlinked bool
+	// The number of file descriptors for the file, which share the
+	// fid and the offset, as duplicates share the file description
+	// in Linux; the fid is clunked when the last one is closed.
+	refs int
+}
+
+func (f *ninepFile) readable() bool {
+	accmode := f.flags & syscall.O_ACCMODE
+	return accmode == syscall.O_RDONLY || accmode == syscall.O_RDWR
+}
+
+func (f *ninepFile) writable() bool {
+	accmode := f.flags & syscall.O_ACCMODE
+	return !f.isDir && (accmode == syscall.O_WRONLY || accmode == syscall.O_RDWR)
+}
+
+// A ninepClient translates system calls into 9P messages, emulating the
+// Linux semantics the operations rely upon.
+type ninepClient struct {
+	c     *clnt.Clnt
+	umask uint32
+
+	// Guards files and nextFd, for concurrent workers.
+	mu     sync.Mutex
+	files  map[int]*ninepFile
+	nextFd int
+}
+
+func newNinepClient(socket string) (*ninepClient, error) {
+	user := p.OsUsers.Uid2User(os.Geteuid())
+	c, err := clnt.Mount("unix", socket, user.Name(), 8192, user)
+	if err != nil {
+		return nil, fmt.Errorf("newNinepClient: %v", err)
+	}
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return &ninepClient{
+		c:     c,
+		umask: uint32(umask),
+		files: make(map[int]*ninepFile),
+		// Large enough not to be mistaken for a kernel file descriptor in logs.
+		nextFd: 1000,
+	}, nil
+}
+
+// Clunks all fids and disconnects.
+func (c *ninepClient) close9P() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for fd, f := range c.files {
+		delete(c.files, fd)
+		if f.refs--; f.refs == 0 {
+			_ = c.c.Clunk(f.fid)
+		}
+	}
+	c.c.Unmount()
+}
+
+// Walks from fid along the pathname, returning a new fid.
+func (c *ninepClient) walk(fid *clnt.Fid, pathname string) (*clnt.Fid, error) {
+	var names []string
+	for _, name := range strings.Split(pathname, "/") {
+		if name != "" && name != "." {
+			names = append(names, name)
+		}
+	}
+	newfid := c.c.FidAlloc()
+	newfid.User = fid.User
+	newfid.Qid = fid.Qid
+	from := fid
+	for {
+		n := len(names)
+		if n > maxWalkElements {
+			n = maxWalkElements
+		}
+		qids, err := c.c.Walk(from, newfid, names[:n])
+		if err != nil {
+			_ = c.c.Clunk(newfid)
+			return nil, ninepError(err)
+		}
+		if len(qids) != n {
+			// Partial walk, newfid was not created.
+			_ = c.c.Clunk(newfid)
+			if len(qids) > 0 && qids[len(qids)-1].Type&p.QTDIR == 0 {
+				return nil, syscall.ENOTDIR
+			}
+			return nil, syscall.ENOENT
+		}
+		if n > 0 {
+			newfid.Qid = qids[n-1]
+		}
+		names = names[n:]
+		from = newfid
+		if len(names) == 0 {
+			return newfid, nil
+		}
+	}
+}
+
+// Creates the file, or directory, and returns a fid for it, open with
+// the given mode.
+func (c *ninepClient) create(fid *clnt.Fid, pathname string, perm uint32, mode uint8) (*clnt.Fid, error) {
+	name := path.Base(pathname)
+	if name == "." || name == ".." || name == "/" {
+		return nil, syscall.EEXIST
+	}
+	dir, err := c.walk(fid, path.Dir(pathname))
+	if err != nil {
+		return nil, err
+	}
+	if dir.Qid.Type&p.QTDIR == 0 {
+		_ = c.c.Clunk(dir)
+		return nil, syscall.ENOTDIR
+	}
+	if err := c.c.Create(dir, name, perm, mode, ""); err != nil {
+		_ = c.c.Clunk(dir)
+		return nil, ninepError(err)
+	}
+	return dir, nil
+}
+
+func (c *ninepClient) file(fd int) (*ninepFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.files[fd]
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+func (c *ninepClient) dir(fd int) (*clnt.Fid, error) {
+	f, err := c.file(fd)
+	if err != nil {
+		return nil, err
+	}
+	if !f.isDir {
+		return nil, syscall.ENOTDIR
+	}
+	return f.fid, nil
+}
+
+func ninepMode(flags int) uint8 {
+	var mode uint8
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mode = p.OREAD
+	case syscall.O_WRONLY:
+		mode = p.OWRITE
+	default:
+		// O_ACCMODE itself needs both permissions, but allows neither reads nor writes.
+		mode = p.ORDWR
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mode |= p.OTRUNC
+	}
+	return mode
+}
+
+func (c *ninepClient) open(pathname string, flags int, mode uint32) (int, error) {
+	return c.openfid(c.c.Root, pathname, flags, mode)
+}
+
+func (c *ninepClient) openat(dirfd int, pathname string, flags int, mode uint32) (int, error) {
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return -1, err
+	}
+	return c.openfid(dir, pathname, flags, mode)
+}
+
+func (c *ninepClient) openfid(dir *clnt.Fid, pathname string, flags int, mode uint32) (int, error) {
+	if flags&unix.O_TMPFILE == unix.O_TMPFILE {
+		return -1, c.tmpfile(dir, pathname, flags)
+	}
+	if flags&syscall.O_CREAT != 0 && flags&syscall.O_DIRECTORY != 0 {
+		return -1, syscall.EINVAL
+	}
+	fid, err := c.walk(dir, pathname)
+	created := false
+	if err == syscall.ENOENT && flags&syscall.O_CREAT != 0 {
+		fid, err = c.create(dir, pathname, ninepPerm(mode&^c.umask), ninepMode(flags))
+		created = true
+	}
+	if err != nil {
+		return -1, err
+	}
+	if !created && flags&(syscall.O_CREAT|syscall.O_EXCL) == syscall.O_CREAT|syscall.O_EXCL {
+		_ = c.c.Clunk(fid)
+		return -1, syscall.EEXIST
+	}
+	f := &ninepFile{fid: fid, flags: flags, refs: 1}
+	if fid.Qid.Type&p.QTDIR != 0 {
+		f.isDir = true
+		if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&(syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+			_ = c.c.Clunk(fid)
+			return -1, syscall.EISDIR
+		}
+	} else {
+		if flags&syscall.O_DIRECTORY != 0 {
+			_ = c.c.Clunk(fid)
+			return -1, syscall.ENOTDIR
+		}
+		if !created {
+			if err := c.c.Open(fid, ninepMode(flags)); err != nil {
+				_ = c.c.Clunk(fid)
+				return -1, ninepError(err)
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fd := c.nextFd
+	c.nextFd++
+	c.files[fd] = f
+	return fd, nil
+}
+
+// There are no unnamed files in 9P, which the Linux 9p driver reports
+// once it finds the directory.
+func (c *ninepClient) tmpfile(dir *clnt.Fid, pathname string, flags int) error {
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY || flags&syscall.O_CREAT != 0 {
+		return syscall.EINVAL
+	}
+	fid, err := c.walk(dir, pathname)
+	if err != nil {
+		return err
+	}
+	_ = c.c.Clunk(fid)
+	if fid.Qid.Type&p.QTDIR == 0 {
+		return syscall.ENOTDIR
+	}
+	return syscall.EOPNOTSUPP
+}
+
+func (c *ninepClient) seek(fd int, offset int64, whence int) (int64, error) {
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	var base int64
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		d, err := c.c.Stat(f.fid)
+		if err != nil {
+			return -1, ninepError(err)
+		}
+		base = int64(d.Length)
+	case seekData, seekHole:
+		// There are no holes in 9P, as for the Linux 9p driver: the data
+		// goes on up to the end, where the only hole is.
+		d, err := c.c.Stat(f.fid)
+		if err != nil {
+			return -1, ninepError(err)
+		}
+		if offset < 0 || offset >= int64(d.Length) {
+			return -1, syscall.ENXIO
+		}
+		if whence == seekHole {
+			base, offset = int64(d.Length), 0
+		}
+	default:
+		return -1, syscall.EINVAL
+	}
+	if base+offset < 0 {
+		return -1, syscall.EINVAL
+	}
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+func (c *ninepClient) read(fd int, b []byte) (int, error) {
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	n, err := c.readAt(f, b, f.offset)
+	if n > 0 {
+		f.offset += int64(n)
+	}
+	return n, err
+}
+
+// As on Linux, a negative offset is checked first.
+func (c *ninepClient) pread(fd int, b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return -1, syscall.EINVAL
+	}
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	return c.readAt(f, b, offset)
+}
+
+// Reads into the buffers in turn, with a single read, so that the
+// outcome is the same as a read into a buffer as big as all of them.
+func (c *ninepClient) readv(fd int, iovs [][]byte) (int, error) {
+	var b []byte
+	for _, iov := range iovs {
+		b = append(b, iov...)
+	}
+	n, err := c.read(fd, b)
+	for i, m := 0, n; m > 0; i++ {
+		m -= copy(iovs[i], b[n-m:n])
+	}
+	return n, err
+}
+
+// Reads at the offset, without changing that of the file.
+func (c *ninepClient) readAt(f *ninepFile, b []byte, offset int64) (int, error) {
+	if f.isDir {
+		return -1, syscall.EISDIR
+	}
+	if !f.readable() {
+		return -1, syscall.EBADF
+	}
+	n := 0
+	for n < len(b) {
+		data, err := c.c.Read(f.fid, uint64(offset)+uint64(n), uint32(len(b)-n))
+		if err != nil {
+			if n > 0 {
+				break
+			}
+			return -1, ninepError(err)
+		}
+		if len(data) == 0 {
+			break
+		}
+		copy(b[n:], data)
+		n += len(data)
+	}
+	return n, nil
+}
+
+func (c *ninepClient) write(fd int, b []byte) (int, error) {
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	n, end, err := c.writeAt(f, b, f.offset)
+	if n > 0 {
+		f.offset = end
+	}
+	return n, err
+}
+
+// As on Linux, a negative offset is checked first, and otherwise the
+// offset is ignored for files open for appending.
+func (c *ninepClient) pwrite(fd int, b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return -1, syscall.EINVAL
+	}
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	n, _, err := c.writeAt(f, b, offset)
+	return n, err
+}
+
+// Writes the buffers in turn, with a single write, cf. readv.
+func (c *ninepClient) writev(fd int, iovs [][]byte) (int, error) {
+	var b []byte
+	for _, iov := range iovs {
+		b = append(b, iov...)
+	}
+	return c.write(fd, b)
+}
+
+// Writes at the offset, or at the end of file if open for appending,
+// without changing the offset of the file. Returns the offset after the
+// bytes written.
+func (c *ninepClient) writeAt(f *ninepFile, b []byte, offset int64) (int, int64, error) {
+	if !f.writable() {
+		return -1, 0, syscall.EBADF
+	}
+	if f.flags&syscall.O_APPEND != 0 {
+		d, err := c.c.Stat(f.fid)
+		if err != nil {
+			return -1, 0, ninepError(err)
+		}
+		offset = int64(d.Length)
+	}
+	n := 0
+	for n < len(b) {
+		m, err := c.c.Write(f.fid, b[n:], uint64(offset))
+		if err != nil {
+			if n > 0 {
+				break
+			}
+			return -1, 0, ninepError(err)
+		}
+		if m == 0 {
+			break
+		}
+		n += m
+		offset += int64(m)
+	}
+	return n, offset, nil
+}
+
+func (c *ninepClient) close(fd int) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.files, fd)
+	f.refs--
+	last := f.refs == 0
+	c.mu.Unlock()
+	if !last {
+		return nil
+	}
+	return ninepError(c.c.Clunk(f.fid))
+}
+
+func (c *ninepClient) dup(fd int) (int, error) {
+	return c.fcntl(fd, unix.F_DUPFD, 0)
+}
+
+// Like dup3(2), closes newfd if open, clunking its fid with the last
+// reference, and makes it refer to the file of oldfd. Only O_CLOEXEC is
+// accepted in flags, and ignored, as nothing is executed.
+func (c *ninepClient) dup3(oldfd int, newfd int, flags int) error {
+	if flags&^unix.O_CLOEXEC != 0 || oldfd == newfd {
+		return syscall.EINVAL
+	}
+	if newfd < 0 {
+		return syscall.EBADF
+	}
+	c.mu.Lock()
+	f, ok := c.files[oldfd]
+	if !ok {
+		c.mu.Unlock()
+		return syscall.EBADF
+	}
+	// Referenced first, in case newfd refers to the same file.
+	f.refs++
+	old, replaced := c.files[newfd]
+	c.files[newfd] = f
+	if c.nextFd <= newfd {
+		c.nextFd = newfd + 1
+	}
+	last := false
+	if replaced {
+		old.refs--
+		last = old.refs == 0
+	}
+	c.mu.Unlock()
+	if last {
+		// Errors closing newfd are silently ignored by dup3(2).
+		_ = c.c.Clunk(old.fid)
+	}
+	return nil
+}
+
+// Only duplicating is supported. File descriptors are never reused, so
+// the new one is the next at or above arg, if not the lowest free one.
+func (c *ninepClient) fcntl(fd int, cmd int, arg int) (int, error) {
+	if cmd != unix.F_DUPFD && cmd != unix.F_DUPFD_CLOEXEC {
+		return -1, syscall.EINVAL
+	}
+	f, err := c.file(fd)
+	if err != nil {
+		return -1, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nextFd < arg {
+		c.nextFd = arg
+	}
+	dupfd := c.nextFd
+	c.nextFd++
+	f.refs++
+	c.files[dupfd] = f
+	return dupfd, nil
+}
+
+func (c *ninepClient) unlinkat(dirfd int, pathname string, flags int) error {
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return err
+	}
+	if flags&unix.AT_REMOVEDIR != 0 {
+		switch path.Base(pathname) {
+		case ".":
+			return syscall.EINVAL
+		case "..":
+			return syscall.ENOTEMPTY
+		}
+	}
+	fid, err := c.walk(dir, pathname)
+	if err != nil {
+		return err
+	}
+	isDir := fid.Qid.Type&p.QTDIR != 0
+	if flags&unix.AT_REMOVEDIR != 0 && !isDir {
+		_ = c.c.Clunk(fid)
+		return syscall.ENOTDIR
+	}
+	if flags&unix.AT_REMOVEDIR == 0 && isDir {
+		_ = c.c.Clunk(fid)
+		return syscall.EISDIR
+	}
+	// Remove clunks the fid, even if it fails.
+	qid := fid.Qid
+	if err := c.c.Remove(fid); err != nil {
+		return ninepError(err)
+	}
+	c.markUnlinked(qid)
+	return nil
+}
+
+// Notes that the file with the given qid has no links left, having been
+// removed, for the file descriptors open on it.
+func (c *ninepClient) markUnlinked(qid p.Qid) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.files {
+		if f.fid.Qid.Path == qid.Path {
+			f.unlinked = true
+		}
+	}
+}
+
+func (c *ninepClient) mkdirat(dirfd int, pathname string, mode uint32) error {
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return err
+	}
+	fid, err := c.walk(dir, pathname)
+	if err == nil {
+		_ = c.c.Clunk(fid)
+		return syscall.EEXIST
+	}
+	if err != syscall.ENOENT {
+		return err
+	}
+	// As for Linux, mkdir ignores setuid and setgid.
+	fid, err = c.create(dir, pathname, ninepPerm(mode&^c.umask&(0777|syscall.S_ISVTX))|p.DMDIR, p.OREAD)
+	if err != nil {
+		return err
+	}
+	return ninepError(c.c.Clunk(fid))
+}
+
+func (c *ninepClient) truncate(pathname string, length int64) error {
+	if length < 0 {
+		return syscall.EINVAL
+	}
+	fid, err := c.walk(c.c.Root, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	if fid.Qid.Type&p.QTDIR != 0 {
+		return syscall.EISDIR
+	}
+	d := p.NewWstatDir()
+	d.Length = uint64(length)
+	return ninepError(c.c.Wstat(fid, d))
+}
+
+func (c *ninepClient) ftruncate(fd int, length int64) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	if length < 0 || !f.writable() {
+		return syscall.EINVAL
+	}
+	d := p.NewWstatDir()
+	d.Length = uint64(length)
+	return ninepError(c.c.Wstat(f.fid, d))
+}
+
+// 9P can't allocate space or punch holes, and the Linux 9p driver
+// doesn't emulate it.
+func (c *ninepClient) fallocate(fd int, mode uint32, offset int64, length int64) error {
+	if _, err := c.file(fd); err != nil {
+		return err
+	}
+	return syscall.EOPNOTSUPP
+}
+
+// Renames within a directory, which is all 9P2000 allows. An existing
+// target is removed first, as rename(2) would replace it.
+func (c *ninepClient) rename(oldpath, newpath string) error {
+	if path.Dir(oldpath) != path.Dir(newpath) {
+		return syscall.EXDEV
+	}
+	fid, err := c.walk(c.c.Root, oldpath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	if path.Clean(oldpath) == path.Clean(newpath) {
+		return nil
+	}
+	target, err := c.walk(c.c.Root, newpath)
+	if err == nil {
+		isDir := fid.Qid.Type&p.QTDIR != 0
+		targetIsDir := target.Qid.Type&p.QTDIR != 0
+		if isDir && !targetIsDir {
+			_ = c.c.Clunk(target)
+			return syscall.ENOTDIR
+		}
+		if !isDir && targetIsDir {
+			_ = c.c.Clunk(target)
+			return syscall.EISDIR
+		}
+		qid := target.Qid
+		if err := c.c.Remove(target); err != nil {
+			return ninepError(err)
+		}
+		c.markUnlinked(qid)
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	d := p.NewWstatDir()
+	d.Name = path.Base(newpath)
+	return ninepError(c.c.Wstat(fid, d))
+}
+
+// Renames across directories and flags are beyond 9P2000, cf.
+// clientOperation.
+func (c *ninepClient) renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) error {
+	return syscall.ENOSYS
+}
+
+// Symbolic links would need the client to resolve pathnames, following
+// links, as the kernel does, so they're not supported, cf.
+// clientOperation.
+func (c *ninepClient) symlinkat(target string, dirfd int, pathname string) error {
+	return syscall.ENOSYS
+}
+
+func (c *ninepClient) readlinkat(dirfd int, pathname string, buf []byte) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+// The 9P2000.u mode bit for the sticky bit, missing from the p package,
+// cf. P9_DMSETVTX in Linux.
+const ninepDMSetVTX = 0x00010000
+
+// Converts Unix permission bits, setuid, setgid and sticky included, to
+// 9P2000.u ones.
+func ninepPerm(mode uint32) uint32 {
+	perm := mode & 0777
+	if mode&syscall.S_ISUID != 0 {
+		perm |= p.DMSETUID
+	}
+	if mode&syscall.S_ISGID != 0 {
+		perm |= p.DMSETGID
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		perm |= ninepDMSetVTX
+	}
+	return perm
+}
+
+// The inverse of ninepPerm.
+func unixPerm(perm uint32) uint32 {
+	mode := perm & 0777
+	if perm&p.DMSETUID != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if perm&p.DMSETGID != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if perm&ninepDMSetVTX != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// Changes the permission bits of the file, keeping the others.
+func (c *ninepClient) chmodfid(fid *clnt.Fid, mode uint32) error {
+	d, err := c.c.Stat(fid)
+	if err != nil {
+		return ninepError(err)
+	}
+	w := p.NewWstatDir()
+	w.Mode = d.Mode&^ninepPerm(supportedModeBits) | ninepPerm(mode)
+	return ninepError(c.c.Wstat(fid, w))
+}
+
+func (c *ninepClient) chmod(pathname string, mode uint32) error {
+	fid, err := c.walk(c.c.Root, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	return c.chmodfid(fid, mode)
+}
+
+func (c *ninepClient) fchmod(fd int, mode uint32) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	return c.chmodfid(f.fid, mode)
+}
+
+func (c *ninepClient) fchmodat(dirfd int, pathname string, mode uint32) error {
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return err
+	}
+	fid, err := c.walk(dir, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	return c.chmodfid(fid, mode)
+}
+
+// Checking access would need the client to know which user and groups
+// the server maps the process to, so it's not supported, cf.
+// clientOperation.
+func (c *ninepClient) faccessat(dirfd int, pathname string, mode uint32) error {
+	return syscall.ENOSYS
+}
+
+// Directory fids aren't open for reading, cf. ninepFile, so directories
+// can't be listed through file descriptors, cf. clientOperation.
+func (c *ninepClient) getdents(fd int, buf []byte) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+// A wstat changing nothing asks the server to commit the file to stable
+// storage, which is what the Linux 9p driver sends for fsync(2).
+func (c *ninepClient) fsync(fd int) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	return ninepError(c.c.Wstat(f.fid, p.NewWstatDir()))
+}
+
+func (c *ninepClient) fdatasync(fd int) error {
+	return c.fsync(fd)
+}
+
+// There's no message to sync a whole file system in 9P, so only the file
+// is synced, which servers committing everything at once, like musclefs,
+// take as syncing all of it.
+func (c *ninepClient) syncfs(fd int) error {
+	return c.fsync(fd)
+}
+
+// 9P2000.u has no extended attributes, cf. clientOperation.
+func (c *ninepClient) setxattr(pathname string, name string, value []byte, flags int) error {
+	return syscall.ENOTSUP
+}
+
+func (c *ninepClient) getxattr(pathname string, name string, value []byte) (int, error) {
+	return -1, syscall.ENOTSUP
+}
+
+func (c *ninepClient) listxattr(pathname string, list []byte) (int, error) {
+	return -1, syscall.ENOTSUP
+}
+
+func (c *ninepClient) removexattr(pathname string, name string) error {
+	return syscall.ENOTSUP
+}
+
+// 9P has no hard links.
+func (c *ninepClient) linkat(olddirfd int, oldpath string, newdirfd int, newpath string, flags int) error {
+	return syscall.ENOSYS
+}
+
+// As there are no symbolic links, the flags make no difference.
+func (c *ninepClient) fstatat(dirfd int, pathname string, st *unix.Stat_t, flags int) error {
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return err
+	}
+	fid, err := c.walk(dir, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	return c.statfid(fid, st)
+}
+
+func (c *ninepClient) fstat(fd int, st *unix.Stat_t) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	if err := c.statfid(f.fid, st); err != nil {
+		return err
+	}
+	if f.unlinked {
+		st.Nlink = 0
+	}
+	return nil
+}
+
+// Fills in the attributes of the file that statSummary, checkTimes and
+// checkStat look at. There's no change time in 9P, the modification
+// time stands in for it. The block counts are made up as by the Linux
+// 9p driver.
+func (c *ninepClient) statfid(fid *clnt.Fid, st *unix.Stat_t) error {
+	d, err := c.c.Stat(fid)
+	if err != nil {
+		return ninepError(err)
+	}
+	*st = unix.Stat_t{}
+	st.Mode = unixPerm(d.Mode)
+	switch {
+	case d.Mode&p.DMDIR != 0:
+		st.Mode |= unix.S_IFDIR
+	case d.Mode&p.DMSYMLINK != 0:
+		st.Mode |= unix.S_IFLNK
+	default:
+		st.Mode |= unix.S_IFREG
+	}
+	st.Ino = d.Qid.Path
+	st.Size = int64(d.Length)
+	st.Blksize = int64(c.c.Msize)
+	st.Blocks = (st.Size + 511) / 512
+	st.Nlink = 1
+	st.Atim.Sec = int64(d.Atime)
+	st.Mtim.Sec = int64(d.Mtime)
+	st.Ctim = st.Mtim
+	return nil
+}
+
+// There's no statfs in 9P2000.u, so as for the Linux 9p driver, only
+// the block size and maximum name length are known, once the file is
+// found.
+func (c *ninepClient) statfs(pathname string, st *unix.Statfs_t) error {
+	fid, err := c.walk(c.c.Root, pathname)
+	if err != nil {
+		return err
+	}
+	_ = c.c.Clunk(fid)
+	*st = unix.Statfs_t{Type: 0x01021997, Bsize: int64(c.c.Msize), Namelen: 255}
+	return nil
+}
+
+// Sets the access and modification times, to the second, the most 9P
+// can represent.
+func (c *ninepClient) utimesfid(fid *clnt.Fid, times []unix.Timespec) error {
+	w := p.NewWstatDir()
+	seconds := func(ts unix.Timespec, field *uint32) {
+		switch ts.Nsec {
+		case unix.UTIME_OMIT:
+		case unix.UTIME_NOW:
+			*field = uint32(time.Now().Unix())
+		default:
+			*field = uint32(ts.Sec)
+		}
+	}
+	seconds(times[0], &w.Atime)
+	seconds(times[1], &w.Mtime)
+	return ninepError(c.c.Wstat(fid, w))
+}
+
+// As there are no symbolic links, the flags make no difference.
+func (c *ninepClient) utimensat(dirfd int, pathname string, times []unix.Timespec, flags int) error {
+	// Linux succeeds before looking up anything.
+	if times[0].Nsec == unix.UTIME_OMIT && times[1].Nsec == unix.UTIME_OMIT {
+		return nil
+	}
+	dir, err := c.dir(dirfd)
+	if err != nil {
+		return err
+	}
+	fid, err := c.walk(dir, pathname)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(fid)
+	}()
+	return c.utimesfid(fid, times)
+}
+
+func (c *ninepClient) futimens(fd int, times []unix.Timespec) error {
+	f, err := c.file(fd)
+	if err != nil {
+		return err
+	}
+	return c.utimesfid(f.fid, times)
+}
+
+// Like hashTree, but walking the tree through 9P.
+func (c *ninepClient) hashTree(includeMeta, includeContent, includeTimes bool) ([]byte, error) {
+	var b bytes.Buffer
+	fid, err := c.walk(c.c.Root, "")
+	if err != nil {
+		return nil, fmt.Errorf("ninepClient.hashTree: %v", err)
+	}
+	err = c.hashAny(&b, fid, "", includeMeta, includeContent, includeTimes)
+	_ = c.c.Clunk(fid)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *ninepClient) hashAny(buf *bytes.Buffer, fid *clnt.Fid, rel string, includeMeta, includeContent, includeTimes bool) error {
+	d, err := c.c.Stat(fid)
+	if err != nil {
+		return fmt.Errorf("ninepClient.hashAny: %q: %v", rel, err)
+	}
+	// The same bits os.Stat reports through the Linux 9p driver.
+	mode := os.FileMode(d.Mode & 0777)
+	if d.Mode&p.DMSETUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if d.Mode&p.DMSETGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if d.Mode&ninepDMSetVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	if d.Mode&p.DMDIR != 0 {
+		mode |= os.ModeDir
+	}
+	if d.Mode&p.DMSYMLINK != 0 {
+		mode |= os.ModeSymlink
+	}
+	mtime := describeTime(time.Unix(int64(d.Mtime), 0))
+	if mode&os.ModeSymlink != 0 {
+		if includeMeta {
+			_, _ = fmt.Fprintf(buf, "path=%q mode=0%o target=%q\n", rel, mode, d.Ext)
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, mtime)
+		}
+	} else if mode.IsDir() {
+		if includeMeta {
+			_, _ = fmt.Fprintf(buf, "path=%q mode=0%o\n", rel, mode)
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, mtime)
+		}
+		names, err := c.readdirnames(fid)
+		if err != nil {
+			return fmt.Errorf("ninepClient.hashAny: %q: %w", rel, err)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child, err := c.walk(fid, name)
+			if err != nil {
+				return fmt.Errorf("ninepClient.hashAny: %q: %w", name, err)
+			}
+			err = c.hashAny(buf, child, filepath.Join(rel, name), includeMeta, includeContent, includeTimes)
+			_ = c.c.Clunk(child)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		if includeMeta {
+			_, _ = fmt.Fprintf(buf, "path=%q size=%d mode=0%o\n", rel, d.Length, mode)
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, mtime)
+		}
+		if includeContent {
+			sum, err := c.hashContent(fid)
+			if err != nil {
+				return fmt.Errorf("ninepClient.hashAny: %q: %w", rel, err)
+			}
+			_, _ = fmt.Fprintf(buf, "path=%q hash=%x\n", rel, sum)
+		}
+	}
+	return nil
+}
+
+// Opens a clone of the fid for reading, and passes it to f.
+func (c *ninepClient) withOpenClone(fid *clnt.Fid, f func(*clnt.Fid) error) error {
+	clone, err := c.walk(fid, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.c.Clunk(clone)
+	}()
+	if err := c.c.Open(clone, p.OREAD); err != nil {
+		return ninepError(err)
+	}
+	return f(clone)
+}
+
+func (c *ninepClient) readdirnames(fid *clnt.Fid) (names []string, err error) {
+	err = c.withOpenClone(fid, func(clone *clnt.Fid) error {
+		dirs, err := clnt.NewFile(clone, 0).Readdir(0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return ninepError(err)
+		}
+		for _, d := range dirs {
+			names = append(names, d.Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// Like hashContent, reading holes as zeros, as 9P has no way to skip them.
+func (c *ninepClient) hashContent(fid *clnt.Fid) (sum []byte, err error) {
+	h := newContentHasher()
+	err = c.withOpenClone(fid, func(clone *clnt.Fid) error {
+		var offset int64
+		for {
+			data, err := c.c.Read(clone, uint64(offset), clone.Iounit)
+			if err != nil {
+				return ninepError(err)
+			}
+			if len(data) == 0 {
+				return nil
+			}
+			h.writeAt(data, offset)
+			offset += int64(len(data))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.sum(), nil
+}
+
+// A ninepfs is a musclefs instance accessed through a ninepClient
+// rather than through the Linux 9p driver. Discrepancies are then due
+// to the server rather than to the kernel client, and no root
+// privileges are needed, as nothing gets mounted.
+type ninepfs struct {
+	muscle *musclefs
+	c      *ninepClient
+}
+
+func (fs *ninepfs) start() error {
+	return fs.muscle.start()
+}
+
+func (fs *ninepfs) stop() error {
+	return fs.muscle.stop()
+}
+
+func (fs *ninepfs) mount() error {
+	socket := fs.muscle.clientSocket()
+	c, err := newNinepClient(socket)
+	if err != nil {
+		return fmt.Errorf("ninepfs.mount: %v", err)
+	}
+	fs.c = c
+	logInfo("ninepfs.mount: connected to %s", socket)
+	return nil
+}
+
+func (fs *ninepfs) unmount() error {
+	if fs.c != nil {
+		fs.c.close9P()
+		fs.c = nil
+	}
+	return nil
+}
+
+// Paths are relative to the root of the 9P file tree.
+func (fs *ninepfs) mountpoint() string {
+	return "/"
+}
+
+func (fs *ninepfs) close() error {
+	return fs.muscle.close()
+}
+
+func (fs *ninepfs) wireTrace() string {
+	return fs.muscle.wireTrace()
+}
+
+func (fs *ninepfs) client() sysClient {
+	return fs.c
+}
+
+func (fs *ninepfs) hashTree(includeMeta, includeContent, includeTimes bool) ([]byte, error) {
+	return fs.c.hashTree(includeMeta, includeContent, includeTimes)
+}
+
+func (fs *ninepfs) restart() error {
+	if err := fs.unmount(); err != nil {
+		return fmt.Errorf("ninepfs.restart: %v", err)
+	}
+	if err := fs.stop(); err != nil {
+		return fmt.Errorf("ninepfs.restart: %v", err)
+	}
+	if err := fs.start(); err != nil {
+		return fmt.Errorf("ninepfs.restart: %v", err)
+	}
+	if err := fs.mount(); err != nil {
+		return fmt.Errorf("ninepfs.restart: %v", err)
+	}
+	return nil
+}
+
+func (fs *ninepfs) kill() error {
+	return fs.muscle.kill()
+}
+
+func (fs *ninepfs) recoverFromKill() error {
+	if err := fs.unmount(); err != nil {
+		return fmt.Errorf("ninepfs.recoverFromKill: %v", err)
+	}
+	if err := fs.start(); err != nil {
+		return fmt.Errorf("ninepfs.recoverFromKill: %v", err)
+	}
+	if err := fs.mount(); err != nil {
+		return fmt.Errorf("ninepfs.recoverFromKill: %v", err)
+	}
+	return nil
+}
+
+func (fs *ninepfs) flush() error {
+	_, err := fs.runCommand("flush\n")
+	return err
+}
+
+func (fs *ninepfs) push() error {
+	_, err := fs.runCommand("push\n")
+	return err
+}
+
+func (fs *ninepfs) pushed() error {
+	return fs.muscle.pushed()
+}
+
+func (fs *ninepfs) waitForSnapshot() error {
+	return fs.muscle.waitForSnapshot()
+}
+
+func (fs *ninepfs) pull() error {
+	return pullWorklog(fs)
+}
+
+func (fs *ninepfs) pruneCache() error {
+	return fs.muscle.pruneCache()
+}
+
+func (fs *ninepfs) runCommand(cmd string) ([]byte, error) {
+	const maxResponseSize = 16384
+	fd, err := fs.c.open("ctl", syscall.O_RDWR|syscall.O_CREAT, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.c.write(fd, []byte(cmd)); err != nil {
+		_ = fs.c.close(fd)
+		return nil, err
+	}
+	if _, err := fs.c.seek(fd, 0, io.SeekStart); err != nil {
+		_ = fs.c.close(fd)
+		return nil, err
+	}
+	b := make([]byte, maxResponseSize)
+	n, err := fs.c.read(fd, b)
+	if err != nil {
+		_ = fs.c.close(fd)
+		return nil, err
+	}
+	b = b[:n]
+	logDebug("ninepfs.runCommand: suti=%d cmd=%q output=%q", suti, cmd, string(b))
+	if err := fs.c.close(fd); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -19,82 +21,84 @@ type operKind int
 const (
 	operCreate operKind = iota
 	operOpen
+	operTmpfile
+	operDup
 	operSeek
 	operRead
 	operWrite
 	operClose
+	operPread
+	operPwrite
+	operReadv
+	operWritev
+	operGetdents
+	operFsync
+	operFdatasync
+	operSyncfs
+	operMmap
+	operMread
+	operMwrite
+	operMsync
+	operMunmap
 	operUnlink1
 	operUnlink2
 
 	operTruncate
 	operFtruncate
+	operFallocate
 
 	operMkdir
 	operRmdir
 
 	operRename1
 	operRename2
+	operRenameat2
 
 	operChdir
 
+	operSymlink
+	operReadlink
+	operLstat
+	operStat
+	operFstat
+	operStatfs
+	operLink
+	operFlink
+
+	operChmod
+	operFchmod
+	operFchmodat
+	operAccess
+
+	operUtimensat
+	operFutimens
+
+	operSetxattr
+	operGetxattr
+	operListxattr
+	operRemovexattr
+
 	operMuscleFlush
 	operMusclePush
 	operMuscleRemount
 	operMusclePruneCache
 	operMuscleTrim
+	operMuscleCrash
 
 	operSwapClients
 
 	operKindCount
 )
 
-func fromString(s string) operKind {
-	switch s {
-	case "create":
-		return operCreate
-	case "open":
-		return operOpen
-	case "seek":
-		return operSeek
-	case "read":
-		return operRead
-	case "write":
-		return operWrite
-	case "close":
-		return operClose
-	case "unlink1":
-		return operUnlink1
-	case "unlink2":
-		return operUnlink2
-	case "truncate":
-		return operTruncate
-	case "ftruncate":
-		return operFtruncate
-	case "mkdir":
-		return operMkdir
-	case "rmdir":
-		return operRmdir
-	case "rename1":
-		return operRename1
-	case "rename2":
-		return operRename2
-	case "chdir":
-		return operChdir
-	case "musclefsflush":
-		return operMuscleFlush
-	case "musclefspush":
-		return operMusclePush
-	case "musclefsremount":
-		return operMuscleRemount
-	case "musclefsprunecache":
-		return operMusclePruneCache
-	case "musclefstrim":
-		return operMuscleTrim
-	case "swapclients":
-		return operSwapClients
-	default:
-		panic(s)
+// Returns the operation with the given name, as in configurations and
+// traces, or an error if there's none.
+func lookupOperKind(s string) (operKind, error) {
+	for oper := operKind(0); oper < operKindCount; oper++ {
+		if oper.String() == s {
+			return oper, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown operation %q", s)
 }
 
 func (code operKind) String() string {
@@ -103,6 +107,10 @@ func (code operKind) String() string {
 		return "create"
 	case operOpen:
 		return "open"
+	case operTmpfile:
+		return "tmpfile"
+	case operDup:
+		return "dup"
 	case operSeek:
 		return "seek"
 	case operRead:
@@ -111,6 +119,32 @@ func (code operKind) String() string {
 		return "write"
 	case operClose:
 		return "close"
+	case operPread:
+		return "pread"
+	case operPwrite:
+		return "pwrite"
+	case operReadv:
+		return "readv"
+	case operWritev:
+		return "writev"
+	case operGetdents:
+		return "getdents"
+	case operFsync:
+		return "fsync"
+	case operFdatasync:
+		return "fdatasync"
+	case operSyncfs:
+		return "syncfs"
+	case operMmap:
+		return "mmap"
+	case operMread:
+		return "mread"
+	case operMwrite:
+		return "mwrite"
+	case operMsync:
+		return "msync"
+	case operMunmap:
+		return "munmap"
 	case operUnlink1:
 		return "unlink1"
 	case operUnlink2:
@@ -119,6 +153,8 @@ func (code operKind) String() string {
 		return "truncate"
 	case operFtruncate:
 		return "ftruncate"
+	case operFallocate:
+		return "fallocate"
 	case operMkdir:
 		return "mkdir"
 	case operRmdir:
@@ -127,8 +163,46 @@ func (code operKind) String() string {
 		return "rename1"
 	case operRename2:
 		return "rename2"
+	case operRenameat2:
+		return "renameat2"
 	case operChdir:
 		return "chdir"
+	case operSymlink:
+		return "symlink"
+	case operReadlink:
+		return "readlink"
+	case operLstat:
+		return "lstat"
+	case operStat:
+		return "stat"
+	case operFstat:
+		return "fstat"
+	case operStatfs:
+		return "statfs"
+	case operLink:
+		return "link"
+	case operFlink:
+		return "flink"
+	case operChmod:
+		return "chmod"
+	case operFchmod:
+		return "fchmod"
+	case operFchmodat:
+		return "fchmodat"
+	case operAccess:
+		return "access"
+	case operUtimensat:
+		return "utimensat"
+	case operFutimens:
+		return "futimens"
+	case operSetxattr:
+		return "setxattr"
+	case operGetxattr:
+		return "getxattr"
+	case operListxattr:
+		return "listxattr"
+	case operRemovexattr:
+		return "removexattr"
 	case operMuscleFlush:
 		return "musclefsflush"
 	case operMusclePush:
@@ -139,6 +213,8 @@ func (code operKind) String() string {
 		return "musclefsprunecache"
 	case operMuscleTrim:
 		return "musclefstrim"
+	case operMuscleCrash:
+		return "musclefscrash"
 	case operSwapClients:
 		return "swapclients"
 	default:
@@ -164,16 +240,19 @@ var (
 
 	// A call to creat() is equivalent to calling open() with flags equal to O_CREAT|O_WRONLY|O_TRUNC.
 	createFlags = syscall.O_CREAT | syscall.O_WRONLY | syscall.O_TRUNC
+
+	// Linux mode bits.
+	supportedModeBits uint32 = 0777 | syscall.S_ISGID | syscall.S_ISUID | syscall.S_ISVTX
 )
 
-func randomOpenFlags() openFlags {
+func randomOpenFlags(rng *rand.Rand) openFlags {
 	// Open in read-write mode 90% of the times, to properly exercise read and write.
 	// Else, most reads/writes will give EBADF.
 	// Leaving this probability inconfigurable.
-	if rand.Intn(10) < 9 {
+	if rng.Intn(10) < 9 {
 		return syscall.O_RDWR
 	}
-	return openFlags(rand.Int()) & supportedOpenFlags
+	return openFlags(rng.Int()) & supportedOpenFlags
 }
 
 func (flags openFlags) String() string {
@@ -193,7 +272,10 @@ func (flags openFlags) String() string {
 	if flags&syscall.O_CREAT != 0 {
 		b.WriteString("|O_CREAT")
 	}
-	if flags&syscall.O_DIRECTORY != 0 {
+	// O_TMPFILE includes O_DIRECTORY.
+	if flags&unix.O_TMPFILE == unix.O_TMPFILE {
+		b.WriteString("|O_TMPFILE")
+	} else if flags&syscall.O_DIRECTORY != 0 {
 		b.WriteString("|O_DIRECTORY")
 	}
 	if flags&syscall.O_EXCL != 0 {
@@ -246,73 +328,347 @@ type oper struct {
 
 	code operKind
 
-	// For operations that require file descriptors (seek, read, write,
-	// close). It's the operation (create or open) that created the file
-	// descriptors to be used. We don't just store the fds because the
-	// parent operation may need to be replayed in musclefs after an
-	// induced crash.
-	parent *oper // seek, read, write, close, ftruncate.
+	// For operations that require file descriptors (dup, seek, read,
+	// write, close, pread, pwrite, readv, writev, getdents, fsync,
+	// fdatasync, syncfs, mmap, ftruncate, fallocate, fstat, flink,
+	// fchmod, futimens). It's the operation (create or open) that
+	// created the file descriptors to be used. We don't just store the
+	// fds because the parent operation may need to be replayed in
+	// musclefs after an induced crash. For syncfs, nil stands for the
+	// current directory. For operations on a mapping (mread, mwrite,
+	// msync, munmap), it's the mmap operation.
+	parent *oper
 
-	pathname    string    // creat, open, mkdir, rmdir, chdir, truncate, rename1, rename2, unlink1, unlink2.
-	newpathname string    // rename1, rename2.
-	flags       openFlags // open.
-	mode        uint32    // creat, open, mkdir.
+	pathname    string    // creat, open, tmpfile (the directory), mkdir, rmdir, chdir, truncate, rename1, rename2, renameat2, unlink1, unlink2, symlink, readlink, lstat, stat, statfs, link, chmod, fchmodat, access, utimensat, setxattr, getxattr, listxattr, removexattr.
+	newpathname string    // rename1, rename2, renameat2, link, flink.
+	target      string    // symlink.
+	flags       openFlags // open, tmpfile; dup: for dup3, O_CLOEXEC or 0, or invalid ones.
+	mode        uint32    // creat, open, tmpfile, mkdir, chmod, fchmod, fchmodat; for access, the accessibility checks, e.g., R_OK; for fallocate, the mode, e.g., FALLOC_FL_KEEP_SIZE.
+	// The access and modification times, possibly UTIME_NOW or UTIME_OMIT.
+	times    []unix.Timespec // utimensat, futimens.
+	atflags  int             // utimensat; flink: AT_EMPTY_PATH, or AT_SYMLINK_FOLLOW to link /proc/self/fd/N.
+	xattr    string          // setxattr, getxattr, removexattr: the attribute name.
+	xflags   int             // setxattr: XATTR_CREATE or XATTR_REPLACE, or 0.
+	rflags   uint            // renameat2: RENAME_NOREPLACE or RENAME_EXCHANGE, or 0.
+	msflags  int             // msync: MS_SYNC or MS_ASYNC, possibly with MS_INVALIDATE.
+	cmd      int             // dup: F_DUPFD or F_DUPFD_CLOEXEC, for fcntl(2) with dupMinFd, or cmdDup or cmdDup3.
+	replaced *oper           // dup: for dup3, the operation whose file descriptors are replaced, closing them.
 
-	rbuf int    // read, truncate, ftruncate.
-	wbuf []byte // write.
+	rbuf int    // read, pread, getdents, truncate, ftruncate, readlink, getxattr, listxattr, mread.
+	wbuf []byte // write, pwrite, writev, setxattr, mwrite.
+	iov  []int  // readv, writev: the lengths of the buffers, which wbuf is split into for writev.
 
-	offset int64 // seek.
-	whence int   // seek.
+	offset int64 // seek, pread, pwrite, mmap, fallocate; mread, mwrite: within the mapping.
+	length int   // mmap: the length of the mapping; fallocate: the length of the range.
+	whence int   // seek, including SEEK_DATA and SEEK_HOLE.
 
 	// Output fields.
 
-	sutn, refn     int    // read, write.
-	sutbuf, refbuf []byte // read.
-	sutfd, reffd   int    // create, open, chdir.
-	sutoff, refoff int64  // seek.
-	suterr, referr error  // create, open, seek, read, write, close, mkdir, rmdir.
+	sutn, refn       int    // read, write, pread, pwrite, readv, writev, getdents, readlink, getxattr, listxattr, mread, mwrite.
+	sutbuf, refbuf   []byte // read, pread, readv (the buffers joined), getdents, readlink, getxattr, listxattr, mread.
+	sutmap, refmap   []byte // mmap, until munmap.
+	refmapfd         int    // mmap, until munmap: the mapped reference file, which the parent may be closed before, see mappedLength.
+	sutfd, reffd     int    // create, open, tmpfile, dup, chdir.
+	sutoff, refoff   int64  // seek.
+	sutstat, refstat string // lstat, stat, fstat, see statSummary.
+	suterr, referr   error  // create, open, seek, read, write, close, mkdir, rmdir.
+	// The operations whose files the reference file system opened again
+	// after a crash, for musclefscrash.
+	reopened []*oper
+
+	// Not an output, but the state of listing the directory through
+	// the file descriptors, for open; dup shares its parent's, see
+	// description.
+	dir *dirIter
 }
 
 // String implements fmt.Stringer.
 func (oper *oper) String() string {
 	b := bytes.NewBuffer(nil)
 	_, _ = fmt.Fprintf(b,
-		"[oper id=%d code=%v parent=%v pathname=%q newpathname=%q flags=%v mode=0%o len(wbuf)=%d rbuf=%d offset=%d whence=%d sutn=%d refn=%d len(sutbuf)=%d len(refbuf)=%d sutfd=%d reffd=%d sutoff=%d refoff=%d suterr=%v referr=%v]",
-		oper.id, oper.code, oper.parent, oper.pathname, oper.newpathname, oper.flags, oper.mode, len(oper.wbuf), oper.rbuf, oper.offset, oper.whence, oper.sutn, oper.refn, len(oper.sutbuf), len(oper.refbuf), oper.sutfd, oper.reffd, oper.sutoff, oper.refoff, oper.suterr, oper.referr)
+		"[oper id=%d code=%v parent=%v pathname=%q newpathname=%q target=%q flags=%v mode=0%o times=%v atflags=%#x xattr=%q xflags=%d rflags=%#x msflags=%#x cmd=%d replaced=%v len(wbuf)=%d rbuf=%d iov=%v offset=%d length=%d whence=%d sutn=%d refn=%d len(sutbuf)=%d len(refbuf)=%d sutfd=%d reffd=%d sutoff=%d refoff=%d sutstat=%q refstat=%q suterr=%v referr=%v]",
+		oper.id, oper.code, oper.parent, oper.pathname, oper.newpathname, oper.target, oper.flags, oper.mode, oper.times, oper.atflags, oper.xattr, oper.xflags, oper.rflags, oper.msflags, oper.cmd, oper.replaced, len(oper.wbuf), oper.rbuf, oper.iov, oper.offset, oper.length, oper.whence, oper.sutn, oper.refn, len(oper.sutbuf), len(oper.refbuf), oper.sutfd, oper.reffd, oper.sutoff, oper.refoff, oper.sutstat, oper.refstat, oper.suterr, oper.referr)
 	return b.String()
 }
 
+// Reports whether the operation failed on the system under test with an
+// error the configuration expects, see config.ExpectedErrorsRaw, where
+// the reference file system succeeded, or failed the same way. Having
+// succeeded, it's undone there, see operSeq.run. Seeks, which can be
+// undone on the system under test too, see oper.sutUndoer, may as well
+// fail on the reference file system only.
+func (oper *oper) expectedError() bool {
+	for _, errno := range oper.expectedErrnos() {
+		if oper.suterr == errno {
+			return oper.referr == nil || oper.referr == errno
+		}
+		if oper.referr == errno && oper.suterr == nil {
+			return oper.code == operSeek
+		}
+	}
+	return false
+}
+
+// Returns the errors the configuration expects for the operation, those
+// for seek_holes if it seeks to data or a hole.
+func (oper *oper) expectedErrnos() []syscall.Errno {
+	if oper.code == operSeek && seeksHoles(oper.whence) {
+		return expectedHoleErrors
+	}
+	return expectedErrors[oper.code]
+}
+
+// Returns how to undo the operation on the reference file system, in
+// case it fails there on the system under test only, with an error the
+// configuration expects, or nil if it can't be undone. What undoing
+// needs is saved now, before running the operation.
+func (oper *oper) undoer(s *operSeq) func() error {
+	if len(oper.expectedErrnos()) == 0 {
+		return nil
+	}
+	switch oper.code {
+	case operPread, operFsync, operFdatasync, operSyncfs, operMread, operMsync, operReadlink,
+		operLstat, operStat, operFstat, operStatfs, operAccess, operGetxattr, operListxattr:
+		return func() error { return nil }
+	case operTmpfile:
+		return func() error { return unix.Close(oper.reffd) }
+	case operMmap:
+		return func() error {
+			_ = unix.Close(oper.refmapfd)
+			return unix.Munmap(oper.refmap)
+		}
+	case operFlink:
+		return func() error { return unix.Unlinkat(s.refcwd, s.relativize(oper.newpathname), 0) }
+	case operSeek, operRead, operReadv:
+		fd := oper.parent.reffd
+		off, err := unix.Seek(fd, 0, io.SeekCurrent)
+		return func() error {
+			if err != nil {
+				return err
+			}
+			_, err := unix.Seek(fd, off, io.SeekStart)
+			return err
+		}
+	case operFallocate:
+		// Through a file descriptor of its own, which may be written to
+		// even if the one of the operation isn't.
+		fd, err := unix.Open(procFd(oper.parent.reffd), unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			_ = unix.Close(fd)
+			return nil
+		}
+		var b []byte
+		if end := oper.offset + int64(oper.length); oper.offset < st.Size {
+			if end > st.Size {
+				end = st.Size
+			}
+			b = make([]byte, end-oper.offset)
+			if _, err := unix.Pread(fd, b, oper.offset); err != nil {
+				_ = unix.Close(fd)
+				return nil
+			}
+		}
+		return func() error {
+			defer func() {
+				_ = unix.Close(fd)
+			}()
+			if err := unix.Ftruncate(fd, st.Size); err != nil {
+				return err
+			}
+			_, err := unix.Pwrite(fd, b, oper.offset)
+			return err
+		}
+	case operSetxattr, operRemovexattr:
+		p := filepath.Join(refDir, oper.pathname)
+		b := make([]byte, 64<<10)
+		n, err := unix.Getxattr(p, oper.xattr, b)
+		return func() error {
+			switch err {
+			case nil:
+				return unix.Setxattr(p, oper.xattr, b[:n], 0)
+			case unix.ENODATA:
+				return unix.Removexattr(p, oper.xattr)
+			default:
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+}
+
+// Returns how to undo the operation on the system under test, in case it
+// fails there on the reference file system only, with an error the
+// configuration expects, or nil if it can't be undone. Only seeks can,
+// by going back to where they started from.
+func (oper *oper) sutUndoer() func() error {
+	if oper.code != operSeek || len(oper.expectedErrnos()) == 0 {
+		return nil
+	}
+	sc := sutClient()
+	fd := oper.parent.sutfd
+	off, err := sc.seek(fd, 0, io.SeekCurrent)
+	return func() error {
+		if err != nil {
+			return err
+		}
+		_, err := sc.seek(fd, off, io.SeekStart)
+		return err
+	}
+}
+
+// The lowest file descriptor fcntl(2) may duplicate into, above those
+// that open(2) and dup(2) use, to exercise both ways of allocating them.
+const dupMinFd = 100
+
+// The dup commands, other than those of fcntl(2), which are positive.
+const (
+	cmdDup  = -1 // dup(2)
+	cmdDup3 = -2 // dup3(2), onto the file descriptors of oper.replaced
+)
+
+// Returns the operation that opened the file description the operation
+// has file descriptors for, which duplicates share, along with the
+// offset.
+func (oper *oper) description() *oper {
+	for oper.code == operDup {
+		oper = oper.parent
+	}
+	return oper
+}
+
+// The path under which the kernel links a file descriptor of the process
+// to its file, which linkat(2) can follow, even for files with no name.
+func procFd(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
 func (oper *oper) run(s *operSeq) {
 	sut := filesystems[suti]
+	sc := sutClient()
 	switch oper.code {
 	case operCreate:
 		p := s.relativize(oper.pathname)
-		oper.sutfd, oper.suterr = syscall.Openat(s.sutcwd, p, createFlags, oper.mode)
+		oper.sutfd, oper.suterr = sc.openat(s.sutcwd, p, createFlags, oper.mode)
 		oper.reffd, oper.referr = syscall.Openat(s.refcwd, p, createFlags, oper.mode)
 	case operOpen:
 		p := s.relativize(oper.pathname)
-		oper.sutfd, oper.suterr = syscall.Openat(s.sutcwd, p, int(oper.flags), oper.mode)
+		oper.dir = nil
+		oper.sutfd, oper.suterr = sc.openat(s.sutcwd, p, int(oper.flags), oper.mode)
 		oper.reffd, oper.referr = syscall.Openat(s.refcwd, p, int(oper.flags), oper.mode)
+	case operTmpfile:
+		p := s.relativize(oper.pathname)
+		oper.sutfd, oper.suterr = sc.openat(s.sutcwd, p, int(oper.flags), oper.mode)
+		oper.reffd, oper.referr = syscall.Openat(s.refcwd, p, int(oper.flags), oper.mode)
+	case operDup:
+		switch oper.cmd {
+		case cmdDup:
+			oper.sutfd, oper.suterr = sc.dup(oper.parent.sutfd)
+			oper.reffd, oper.referr = unix.Dup(oper.parent.reffd)
+		case cmdDup3:
+			oper.sutfd, oper.reffd = -1, -1
+			if oper.suterr = sc.dup3(oper.parent.sutfd, oper.replaced.sutfd, int(oper.flags)); oper.suterr == nil {
+				oper.sutfd = oper.replaced.sutfd
+			}
+			if oper.referr = unix.Dup3(oper.parent.reffd, oper.replaced.reffd, int(oper.flags)); oper.referr == nil {
+				oper.reffd = oper.replaced.reffd
+			}
+		default:
+			oper.sutfd, oper.suterr = sc.fcntl(oper.parent.sutfd, oper.cmd, dupMinFd)
+			oper.reffd, oper.referr = unix.FcntlInt(uintptr(oper.parent.reffd), oper.cmd, dupMinFd)
+		}
 	case operSeek:
-		oper.sutoff, oper.suterr = syscall.Seek(oper.parent.sutfd, oper.offset, oper.whence)
+		oper.sutoff, oper.suterr = sc.seek(oper.parent.sutfd, oper.offset, oper.whence)
 		oper.refoff, oper.referr = syscall.Seek(oper.parent.reffd, oper.offset, oper.whence)
 	case operRead:
 		oper.sutbuf = make([]byte, oper.rbuf)
 		oper.refbuf = make([]byte, oper.rbuf)
-		oper.sutn, oper.suterr = syscall.Read(oper.parent.sutfd, oper.sutbuf)
+		oper.sutn, oper.suterr = sc.read(oper.parent.sutfd, oper.sutbuf)
 		oper.refn, oper.referr = syscall.Read(oper.parent.reffd, oper.refbuf)
 	case operWrite:
-		oper.sutn, oper.suterr = syscall.Write(oper.parent.sutfd, oper.wbuf)
+		oper.sutn, oper.suterr = sc.write(oper.parent.sutfd, oper.wbuf)
 		oper.refn, oper.referr = syscall.Write(oper.parent.reffd, oper.wbuf)
 	case operClose:
-		oper.suterr = syscall.Close(oper.parent.sutfd)
+		oper.suterr = sc.close(oper.parent.sutfd)
 		oper.referr = syscall.Close(oper.parent.reffd)
+	case operPread:
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = sc.pread(oper.parent.sutfd, oper.sutbuf, oper.offset)
+		oper.refn, oper.referr = unix.Pread(oper.parent.reffd, oper.refbuf, oper.offset)
+	case operPwrite:
+		oper.sutn, oper.suterr = sc.pwrite(oper.parent.sutfd, oper.wbuf, oper.offset)
+		oper.refn, oper.referr = unix.Pwrite(oper.parent.reffd, oper.wbuf, oper.offset)
+	case operReadv:
+		size := 0
+		for _, l := range oper.iov {
+			size += l
+		}
+		oper.sutbuf = make([]byte, size)
+		oper.refbuf = make([]byte, size)
+		oper.sutn, oper.suterr = sc.readv(oper.parent.sutfd, splitIov(oper.sutbuf, oper.iov))
+		oper.refn, oper.referr = unix.Readv(oper.parent.reffd, splitIov(oper.refbuf, oper.iov))
+	case operWritev:
+		oper.sutn, oper.suterr = sc.writev(oper.parent.sutfd, splitIov(oper.wbuf, oper.iov))
+		oper.refn, oper.referr = unix.Writev(oper.parent.reffd, splitIov(oper.wbuf, oper.iov))
+	case operGetdents:
+		oper.parent.dirIter().observe(oper.parent.reffd)
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = sc.getdents(oper.parent.sutfd, oper.sutbuf)
+		oper.refn, oper.referr = unix.Getdents(oper.parent.reffd, oper.refbuf)
+	case operFsync, operFdatasync, operSyncfs:
+		sutfd, reffd := s.sutcwd, s.refcwd
+		if oper.parent != nil {
+			sutfd, reffd = oper.parent.sutfd, oper.parent.reffd
+		}
+		switch oper.code {
+		case operFsync:
+			oper.suterr = sc.fsync(sutfd)
+			oper.referr = unix.Fsync(reffd)
+		case operFdatasync:
+			oper.suterr = sc.fdatasync(sutfd)
+			oper.referr = unix.Fdatasync(reffd)
+		default:
+			oper.suterr = sc.syncfs(sutfd)
+			oper.referr = unix.Syncfs(reffd)
+		}
+	case operMmap:
+		// Mappings need the kernel, so there's no client, see clientOperation.
+		oper.sutmap, oper.suterr = unix.Mmap(oper.parent.sutfd, oper.offset, oper.length, mmapProt, unix.MAP_SHARED)
+		oper.refmap, oper.referr = unix.Mmap(oper.parent.reffd, oper.offset, oper.length, mmapProt, unix.MAP_SHARED)
+		if oper.referr == nil {
+			if oper.refmapfd, oper.referr = unix.FcntlInt(uintptr(oper.parent.reffd), unix.F_DUPFD_CLOEXEC, 0); oper.referr != nil {
+				_ = unix.Munmap(oper.refmap)
+			}
+		}
+	case operMread:
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = mread(oper.parent.sutmap, oper.offset, oper.sutbuf)
+		oper.refn, oper.referr = mread(oper.parent.refmap, oper.offset, oper.refbuf)
+	case operMwrite:
+		oper.sutn, oper.suterr = mwrite(oper.parent.sutmap, oper.offset, oper.wbuf)
+		oper.refn, oper.referr = mwrite(oper.parent.refmap, oper.offset, oper.wbuf)
+	case operMsync:
+		oper.suterr = unix.Msync(oper.parent.sutmap, oper.msflags)
+		oper.referr = unix.Msync(oper.parent.refmap, oper.msflags)
+	case operMunmap:
+		oper.suterr = unix.Munmap(oper.parent.sutmap)
+		oper.referr = unix.Munmap(oper.parent.refmap)
+		if oper.referr == nil {
+			_ = unix.Close(oper.parent.refmapfd)
+		}
 	case operUnlink1:
 		p := s.relativize(oper.pathname)
-		oper.suterr = syscall.Unlinkat(s.sutcwd, p)
+		oper.suterr = sc.unlinkat(s.sutcwd, p, 0)
 		oper.referr = syscall.Unlinkat(s.refcwd, p)
 	case operUnlink2:
-		_, oper.suterr = sut.runCommand("unlink " + oper.pathname)
+		_, oper.suterr = sut.(commander).runCommand("unlink " + oper.pathname)
 		if oper.suterr != nil && oper.suterr.Error() == "device or resource busy" {
 			// Musclefs can't unlink file trees if they have any fids pointing to them.
 			// In that case, pretend the reference file system will also deny the operation.
@@ -346,24 +702,32 @@ func (oper *oper) run(s *operSeq) {
 			e = errors.Unwrap(oper.referr)
 		}
 	case operTruncate:
-		oper.suterr = syscall.Truncate(filepath.Join(sut.mnt, oper.pathname), int64(oper.rbuf))
+		oper.suterr = sc.truncate(filepath.Join(sut.mountpoint(), oper.pathname), int64(oper.rbuf))
 		oper.referr = syscall.Truncate(filepath.Join(refDir, oper.pathname), int64(oper.rbuf))
+		s.truncated(oper)
 	case operFtruncate:
-		oper.suterr = syscall.Ftruncate(oper.parent.sutfd, int64(oper.rbuf))
+		oper.suterr = sc.ftruncate(oper.parent.sutfd, int64(oper.rbuf))
 		oper.referr = syscall.Ftruncate(oper.parent.reffd, int64(oper.rbuf))
+		s.truncated(oper)
+	case operFallocate:
+		oper.suterr = sc.fallocate(oper.parent.sutfd, oper.mode, oper.offset, int64(oper.length))
+		oper.referr = unix.Fallocate(oper.parent.reffd, oper.mode, oper.offset, int64(oper.length))
+		if oper.referr == nil && oper.mode&unix.FALLOC_FL_KEEP_SIZE != 0 && oper.mode&unix.FALLOC_FL_PUNCH_HOLE == 0 {
+			s.preallocate(oper.parent, oper.offset+int64(oper.length))
+		}
 	case operMkdir:
 		p := s.relativize(oper.pathname)
-		oper.suterr = syscall.Mkdirat(s.sutcwd, p, oper.mode)
+		oper.suterr = sc.mkdirat(s.sutcwd, p, oper.mode)
 		oper.referr = syscall.Mkdirat(s.refcwd, p, oper.mode)
 	case operRmdir:
 		p := s.relativize(oper.pathname)
-		oper.suterr = unix.Unlinkat(s.sutcwd, p, unix.AT_REMOVEDIR)
+		oper.suterr = sc.unlinkat(s.sutcwd, p, unix.AT_REMOVEDIR)
 		oper.referr = unix.Unlinkat(s.refcwd, p, unix.AT_REMOVEDIR)
 	case operRename1:
-		oper.suterr = syscall.Rename(filepath.Join(sut.mnt, oper.pathname), filepath.Join(sut.mnt, oper.newpathname))
+		oper.suterr = sc.rename(filepath.Join(sut.mountpoint(), oper.pathname), filepath.Join(sut.mountpoint(), oper.newpathname))
 		oper.referr = syscall.Rename(filepath.Join(refDir, oper.pathname), filepath.Join(refDir, oper.newpathname))
 	case operRename2:
-		_, oper.suterr = sut.runCommand(fmt.Sprintf("rename %s %s", oper.pathname, oper.newpathname))
+		_, oper.suterr = sut.(commander).runCommand(fmt.Sprintf("rename %s %s", oper.pathname, oper.newpathname))
 		if oper.suterr != nil && oper.suterr.Error() == "device or resource busy" {
 			// Musclefs can't rename files if they have any fids pointing to them.
 			// In that case, pretend the reference file system will also deny the operation.
@@ -372,75 +736,162 @@ func (oper *oper) run(s *operSeq) {
 		} else {
 			oper.referr = syscall.Rename(filepath.Join(refDir, oper.pathname), filepath.Join(refDir, oper.newpathname))
 		}
+	case operRenameat2:
+		p, newp := s.relativize(oper.pathname), s.relativize(oper.newpathname)
+		oper.suterr = sc.renameat2(s.sutcwd, p, s.sutcwd, newp, oper.rflags)
+		oper.referr = unix.Renameat2(s.refcwd, p, s.refcwd, newp, oper.rflags)
 	case operChdir:
-		f := func(oldcwd int, newcwdpath string) (newcwd int, err error) {
+		f := func(c sysClient, oldcwd int, newcwdpath string) (newcwd int, err error) {
 			if oldcwd <= 0 {
 				panic(fmt.Sprintf("bad fd %d", oldcwd))
 			}
-			if err := syscall.Close(oldcwd); err != nil {
+			if err := c.close(oldcwd); err != nil {
 				return -1, err
 			}
-			fd, err := syscall.Open(newcwdpath, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+			fd, err := c.open(newcwdpath, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
 			if err != nil {
 				return -1, err
 			}
 			return fd, nil
 		}
-		oper.sutfd, oper.suterr = f(s.sutcwd, filepath.Join(sut.mnt, oper.pathname))
-		oper.reffd, oper.referr = f(s.refcwd, filepath.Join(refDir, oper.pathname))
+		oper.sutfd, oper.suterr = f(sc, s.sutcwd, filepath.Join(sut.mountpoint(), oper.pathname))
+		oper.reffd, oper.referr = f(kernelClient{}, s.refcwd, filepath.Join(refDir, oper.pathname))
+	case operSymlink:
+		p := s.relativize(oper.pathname)
+		oper.suterr = sc.symlinkat(oper.target, s.sutcwd, p)
+		oper.referr = unix.Symlinkat(oper.target, s.refcwd, p)
+	case operReadlink:
+		p := s.relativize(oper.pathname)
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = sc.readlinkat(s.sutcwd, p, oper.sutbuf)
+		oper.refn, oper.referr = unix.Readlinkat(s.refcwd, p, oper.refbuf)
+	case operLstat:
+		p := s.relativize(oper.pathname)
+		var sutst, refst unix.Stat_t
+		if oper.suterr = sc.fstatat(s.sutcwd, p, &sutst, unix.AT_SYMLINK_NOFOLLOW); oper.suterr == nil {
+			oper.sutstat = statSummary(&sutst)
+		}
+		if oper.referr = unix.Fstatat(s.refcwd, p, &refst, unix.AT_SYMLINK_NOFOLLOW); oper.referr == nil {
+			oper.refstat = statSummary(&refst)
+		}
+	case operStat:
+		p := s.relativize(oper.pathname)
+		var sutst, refst unix.Stat_t
+		if oper.suterr = sc.fstatat(s.sutcwd, p, &sutst, 0); oper.suterr == nil {
+			oper.sutstat = statSummary(&sutst)
+		}
+		if oper.referr = unix.Fstatat(s.refcwd, p, &refst, 0); oper.referr == nil {
+			oper.refstat = statSummary(&refst)
+		}
+	case operFstat:
+		var sutst, refst unix.Stat_t
+		if oper.suterr = sc.fstat(oper.parent.sutfd, &sutst); oper.suterr == nil {
+			oper.sutstat = statSummary(&sutst)
+		}
+		if oper.referr = unix.Fstat(oper.parent.reffd, &refst); oper.referr == nil {
+			oper.refstat = statSummary(&refst)
+		}
+	case operStatfs:
+		// The counts differ between file systems, checkStat looks at them.
+		var sutfs, reffs unix.Statfs_t
+		oper.suterr = sc.statfs(filepath.Join(sut.mountpoint(), oper.pathname), &sutfs)
+		oper.referr = unix.Statfs(filepath.Join(refDir, oper.pathname), &reffs)
+	case operLink:
+		p, newp := s.relativize(oper.pathname), s.relativize(oper.newpathname)
+		oper.suterr = sc.linkat(s.sutcwd, p, s.sutcwd, newp, 0)
+		oper.referr = unix.Linkat(s.refcwd, p, s.refcwd, newp, 0)
+	case operFlink:
+		newp := s.relativize(oper.newpathname)
+		if oper.atflags&unix.AT_EMPTY_PATH != 0 {
+			oper.suterr = sc.linkat(oper.parent.sutfd, "", s.sutcwd, newp, oper.atflags)
+		} else {
+			oper.suterr = sc.linkat(unix.AT_FDCWD, procFd(oper.parent.sutfd), s.sutcwd, newp, oper.atflags)
+		}
+		if oper.atflags&unix.AT_EMPTY_PATH != 0 {
+			oper.referr = unix.Linkat(oper.parent.reffd, "", s.refcwd, newp, oper.atflags)
+		} else {
+			oper.referr = unix.Linkat(unix.AT_FDCWD, procFd(oper.parent.reffd), s.refcwd, newp, oper.atflags)
+		}
+	case operChmod:
+		oper.suterr = sc.chmod(filepath.Join(sut.mountpoint(), oper.pathname), oper.mode)
+		oper.referr = syscall.Chmod(filepath.Join(refDir, oper.pathname), oper.mode)
+	case operFchmod:
+		oper.suterr = sc.fchmod(oper.parent.sutfd, oper.mode)
+		oper.referr = syscall.Fchmod(oper.parent.reffd, oper.mode)
+	case operFchmodat:
+		p := s.relativize(oper.pathname)
+		oper.suterr = sc.fchmodat(s.sutcwd, p, oper.mode)
+		oper.referr = unix.Fchmodat(s.refcwd, p, oper.mode, 0)
+	case operAccess:
+		p := s.relativize(oper.pathname)
+		oper.suterr = sc.faccessat(s.sutcwd, p, oper.mode)
+		oper.referr = unix.Faccessat(s.refcwd, p, oper.mode, 0)
+	case operUtimensat:
+		p := s.relativize(oper.pathname)
+		oper.suterr = sc.utimensat(s.sutcwd, p, oper.times, oper.atflags)
+		oper.referr = unix.UtimesNanoAt(s.refcwd, p, oper.times, oper.atflags)
+	case operFutimens:
+		oper.suterr = sc.futimens(oper.parent.sutfd, oper.times)
+		oper.referr = kernelClient{}.futimens(oper.parent.reffd, oper.times)
+	case operSetxattr:
+		oper.suterr = sc.setxattr(filepath.Join(sut.mountpoint(), oper.pathname), oper.xattr, oper.wbuf, oper.xflags)
+		oper.referr = unix.Setxattr(filepath.Join(refDir, oper.pathname), oper.xattr, oper.wbuf, oper.xflags)
+	case operGetxattr:
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = sc.getxattr(filepath.Join(sut.mountpoint(), oper.pathname), oper.xattr, oper.sutbuf)
+		oper.refn, oper.referr = unix.Getxattr(filepath.Join(refDir, oper.pathname), oper.xattr, oper.refbuf)
+	case operListxattr:
+		oper.sutbuf = make([]byte, oper.rbuf)
+		oper.refbuf = make([]byte, oper.rbuf)
+		oper.sutn, oper.suterr = sc.listxattr(filepath.Join(sut.mountpoint(), oper.pathname), oper.sutbuf)
+		oper.refn, oper.referr = unix.Listxattr(filepath.Join(refDir, oper.pathname), oper.refbuf)
+	case operRemovexattr:
+		oper.suterr = sc.removexattr(filepath.Join(sut.mountpoint(), oper.pathname), oper.xattr)
+		oper.referr = unix.Removexattr(filepath.Join(refDir, oper.pathname), oper.xattr)
 	case operMuscleFlush:
-		_, oper.suterr = sut.runCommand("flush\n")
+		oper.suterr = sut.(flusher).flush()
 	case operMusclePush:
-		_, oper.suterr = sut.runCommand("push\n")
+		oper.suterr = sut.(pusher).push()
 	case operMuscleRemount:
-		oper.suterr = sut.restart(s)
+		oper.suterr = func() error {
+			if err := s.closeAll(); err != nil {
+				return fmt.Errorf("oper.run: %v", err)
+			}
+			return sut.(remounter).restart()
+		}()
 	case operMusclePruneCache:
 		oper.suterr = func() error {
-			if _, err := sut.runCommand("push\n"); err != nil {
+			if err := sut.(pusher).push(); err != nil {
 				return err
 			}
-			if err := sut.waitForSnapshot(); err != nil {
+			if err := sut.(pusher).waitForSnapshot(); err != nil {
 				return err
 			}
-			return sut.pruneCache()
+			return sut.(cachePruner).pruneCache()
 		}()
 	case operMuscleTrim:
-		_, oper.suterr = sut.runCommand("trim\n")
+		_, oper.suterr = sut.(commander).runCommand("trim\n")
+	case operMuscleCrash:
+		oper.reopened = nil
+		oper.suterr = s.crash(sut.(crasher), oper)
 	case operSwapClients:
 		oper.suterr = func() error {
 			if err := s.closeAll(); err != nil {
 				return fmt.Errorf("oper.run: %v", err)
 			}
-			if _, err := sut.runCommand("push\n"); err != nil {
+			if err := sut.(pusher).push(); err != nil {
 				return fmt.Errorf("oper.run: %v", err)
 			}
-			if err := sut.waitForSnapshot(); err != nil {
+			if err := sut.(pusher).waitForSnapshot(); err != nil {
 				return fmt.Errorf("oper.run: %v", err)
 			}
 			suti++
 			suti %= 2
-			sut = filesystems[suti]
-			worklog, err := sut.runCommand("pull\n")
-			if err != nil {
+			if err := filesystems[suti].(puller).pull(); err != nil {
 				return fmt.Errorf("oper.run: %v", err)
 			}
-			s := bufio.NewScanner(bytes.NewReader(worklog))
-			for s.Scan() {
-				command := s.Text()
-				logDebug("oper.run: got pull command %q", command)
-				switch {
-				case command[0] == '#':
-					// Ignore comment.
-				case strings.HasPrefix(command, "graft2 "), strings.HasPrefix(command, "unlink "), command == "flush", command == "pull":
-					if _, err := sut.runCommand(command + "\n"); err != nil {
-						return fmt.Errorf("run.oper: error running command %q from pull worklog: %v", command, err)
-					}
-				default:
-					return fmt.Errorf("run.oper: unexpected command from pull worklog: %q", command)
-				}
-			}
-			// No error from scanning a bytes.Reader.
-			_ = s.Err()
 			return nil
 		}()
 	default:
@@ -448,7 +899,64 @@ func (oper *oper) run(s *operSeq) {
 	}
 }
 
+// Describes the attributes of a file that must be the same on any file
+// system. The size of directories isn't, e.g., it's 0 on musclefs and a
+// multiple of the block size on ext4, and so is their link count.
+func statSummary(st *unix.Stat_t) string {
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return fmt.Sprintf("mode=0%o", st.Mode)
+	}
+	return fmt.Sprintf("mode=0%o size=%d nlink=%d", st.Mode, st.Size, st.Nlink)
+}
+
+// Splits the buffer into consecutive ones of the given lengths, for
+// readv(2) and writev(2).
+func splitIov(b []byte, lens []int) [][]byte {
+	iovs := make([][]byte, len(lens))
+	for i, l := range lens {
+		iovs[i], b = b[:l], b[l:]
+	}
+	return iovs
+}
+
+// Returns the sorted names in a list as returned by listxattr(2),
+// each terminated by a null byte.
+func xattrNames(list []byte) []string {
+	names := strings.Split(string(list), "\x00")
+	// There's an empty string after the last terminator.
+	names = names[:len(names)-1]
+	sort.Strings(names)
+	return names
+}
+
+// A mismatchError reports a discrepancy between the file system under
+// test and the reference file system, detected after running the
+// operation with the given id. The operation code and the kind of
+// mismatch form the signature of a failure.
+type mismatchError struct {
+	id   int
+	code operKind
+	kind string
+	msg  string
+}
+
+// Error implements error.
+func (e *mismatchError) Error() string {
+	return e.msg
+}
+
+func (e *mismatchError) signature() string {
+	return fmt.Sprintf("%v/%s", e.code, e.kind)
+}
+
+func (op *oper) mismatch(kind string, format string, a ...interface{}) error {
+	return &mismatchError{id: op.id, code: op.code, kind: kind, msg: fmt.Sprintf(format, a...)}
+}
+
 func (op *oper) errorsMatch() bool {
+	if op.expectedError() {
+		return true
+	}
 	// Exception: relaxed comparison for rename(2), because I've spent too many hours trying to make ext4 and musclefs match exactly.
 	// Same exception for unlink2, which is a musclefs-specific operation, so there's no point matching errors exactly.
 	if op.code == operRename2 || op.code == operUnlink2 {
@@ -456,13 +964,6 @@ func (op *oper) errorsMatch() bool {
 		good = good || (op.suterr != nil && op.referr != nil)
 		return good
 	}
-	// Exception: Relaxed comparison for seek(2).
-	// This discrepancy seems to come from the Linux 9p driver, rather than musclefs.
-	// The discrepancy doesn't seem to have ripple effects, hence ignoring it for now.
-	// TODO(nicolagi): Investigate more.
-	if op.code == operSeek && op.suterr == nil && op.referr != nil && op.referr.Error() == "invalid argument" {
-		return true
-	}
 	if op.suterr != nil && op.referr != nil {
 		return op.suterr.Error() == op.referr.Error()
 	}
@@ -473,68 +974,137 @@ func (op *oper) errorsMatch() bool {
 // This also does post-condition checks for musclefs-only operations.
 func (op *oper) outputsMatch(seq *operSeq) error {
 	if !op.errorsMatch() {
-		return errors.New("oper.outputsMatch: mismatching errors")
+		return op.mismatch("errors", "oper.outputsMatch: mismatching errors")
+	}
+	if op.code == operSeek && seeksHoles(op.whence) {
+		return op.checkHoles()
 	}
 	if op.referr != nil {
 		// No point doing other checks.
 		return nil
 	}
 	switch op.code {
-	case operCreate, operOpen:
+	case operCreate, operOpen, operTmpfile, operDup:
 		if op.sutfd < 0 || op.reffd < 0 {
-			return fmt.Errorf("%v: negative fd(s)", op.code)
+			return op.mismatch("fd", "%v: negative fd(s)", op.code)
 		}
 	case operSeek:
 		if op.sutoff != op.refoff {
 			// It's not a 9P operation, musclefs doesn't even see the call to seek(2).
 			logWarn("oper.outputsMatch: different offets after seek")
 		}
-	case operRead:
+	case operRead, operPread, operReadv, operMread:
 		if op.sutn != op.refn {
-			return errors.New("read: number of bytes mismatch")
+			return op.mismatch("count", "%v: number of bytes mismatch", op.code)
 		} else if !bytes.Equal(op.sutbuf, op.refbuf) {
-			return fmt.Errorf("read: mismatch sut=%q ref=%q", op.sutbuf, op.refbuf)
+			return op.mismatch("data", "%v: mismatch sut=%q ref=%q", op.code, op.sutbuf, op.refbuf)
 		}
-	case operWrite:
+	case operWrite, operPwrite, operWritev, operMwrite:
 		if op.sutn != op.refn {
-			return errors.New("write: number of bytes mismatch")
+			return op.mismatch("count", "%v: number of bytes mismatch", op.code)
+		}
+		fds := op.parent
+		if op.code == operMwrite {
+			fds = op.parent.parent
+		}
+		if seq.isOpen(fds) {
+			if err := seq.checkMappings(fds); err != nil {
+				return op.mismatch("coherence", "%v: %v", op.code, err)
+			}
+		}
+	case operGetdents:
+		// The entries come in a different order on each file system,
+		// so they can only be compared once listed in full.
+		if err := op.parent.dirIter().add(op); err != nil {
+			return op.mismatch("dirents", "getdents: %v", err)
+		}
+	case operFsync, operFdatasync, operSyncfs:
+	case operMmap:
+	case operMsync:
+		if op.msflags&unix.MS_SYNC != 0 && seq.isOpen(op.parent.parent) {
+			if err := seq.checkMappings(op.parent.parent); err != nil {
+				return op.mismatch("coherence", "msync: %v", err)
+			}
 		}
+	case operMunmap:
 	case operClose:
 	case operUnlink1:
 	case operUnlink2:
 	case operTruncate:
 	case operFtruncate:
+		if seq.isOpen(op.parent) {
+			if err := seq.checkMappings(op.parent); err != nil {
+				return op.mismatch("coherence", "ftruncate: %v", err)
+			}
+		}
+	case operFallocate:
+		if op.mode&unix.FALLOC_FL_PUNCH_HOLE != 0 {
+			if err := op.checkPunched(); err != nil {
+				return op.mismatch("holes", "fallocate: %v", err)
+			}
+		}
 	case operMkdir:
 	case operRmdir:
 	case operRename1:
 	case operRename2:
+	case operRenameat2:
 	case operChdir:
-	case operMuscleFlush:
-	case operMusclePush:
-		count := func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				return fmt.Errorf("found file: %v", path)
+	case operSymlink:
+	case operReadlink:
+		if op.sutn != op.refn {
+			return op.mismatch("count", "readlink: number of bytes mismatch")
+		} else if !bytes.Equal(op.sutbuf[:op.sutn], op.refbuf[:op.refn]) {
+			return op.mismatch("data", "readlink: mismatch sut=%q ref=%q", op.sutbuf[:op.sutn], op.refbuf[:op.refn])
+		}
+	case operLstat, operStat, operFstat:
+		if op.sutstat != op.refstat {
+			return op.mismatch("stat", "%v: mismatch sut=%q ref=%q", op.code, op.sutstat, op.refstat)
+		}
+	case operStatfs:
+	case operLink:
+	case operFlink:
+	case operChmod:
+	case operFchmod:
+	case operFchmodat:
+	case operAccess:
+	case operUtimensat:
+	case operFutimens:
+	case operSetxattr:
+	case operGetxattr:
+		if op.sutn != op.refn {
+			return op.mismatch("count", "getxattr: number of bytes mismatch")
+		} else if op.rbuf > 0 && !bytes.Equal(op.sutbuf[:op.sutn], op.refbuf[:op.refn]) {
+			return op.mismatch("data", "getxattr: mismatch sut=%q ref=%q", op.sutbuf[:op.sutn], op.refbuf[:op.refn])
+		}
+	case operListxattr:
+		if op.sutn != op.refn {
+			return op.mismatch("count", "listxattr: number of bytes mismatch")
+		} else if op.rbuf > 0 {
+			// The order of the names is unspecified.
+			sutnames, refnames := xattrNames(op.sutbuf[:op.sutn]), xattrNames(op.refbuf[:op.refn])
+			if !reflect.DeepEqual(sutnames, refnames) {
+				return op.mismatch("data", "listxattr: mismatch sut=%q ref=%q", sutnames, refnames)
 			}
-			return nil
 		}
-		sut := filesystems[suti]
-		if err := filepath.Walk(sut.staging, count); err != nil {
+	case operRemovexattr:
+	case operMuscleFlush:
+	case operMusclePush:
+		sut := filesystems[suti].(pusher)
+		if err := sut.pushed(); err != nil {
 			// If a file was removed but there's a fid still pointing to it,
 			// it makes sense that the staging are is not empty. So let's
 			// close all files, and do the outputsMatch again. It should then pass.
 			if err := seq.closeAll(); err != nil {
 				return err
 			}
-			if err := filepath.Walk(sut.staging, count); err != nil {
-				return err
+			if err := sut.pushed(); err != nil {
+				return op.mismatch("staging", "%v: %v", op.code, err)
 			}
 		}
 	case operMuscleRemount:
 	case operMusclePruneCache:
 	case operMuscleTrim:
+	case operMuscleCrash:
 	case operSwapClients:
 	default:
 		panic(fmt.Sprintf("unknown op code: %v", op.code))
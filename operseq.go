@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -24,81 +25,220 @@ type operSeq struct {
 	refcwd  int
 	cwdpath string
 
-	existingDirs  map[string]struct{}
-	existingFiles map[string]struct{}
+	// All random choices come from here, for reproducibility.
+	rng *rand.Rand
+
+	existingDirs  *pathSet
+	existingFiles *pathSet
+	existingLinks *pathSet
+	aliases       *aliasMap
 	openOpers     []*oper
+	// The mmap operations whose mappings are still in place.
+	mappedOpers []*oper
+	// Files with space allocated past their end, by fallocate, up to
+	// the given offset, cf. statHolds.
+	preallocated map[fileID]int64
+
+	// If not nil, every operation is recorded here after running.
+	trace *traceWriter
+
+	// If not nil, operations are taken from here rather than generated.
+	replay []*oper
+
+	// If not empty, holds a copy of the reference file system as of the
+	// last operation after which the sut state must survive a crash.
+	durableDir string
+	// The files in it, by path, and those synced since. Once anything is
+	// synced, the sut may have persisted more than the durable state.
+	durableIDs  map[string]fileID
+	synced      []syncedFile
+	syncedSince bool
+
+	sizes sizeConfig
+}
+
+func newOperSeq(max int, cfg *config, seed int64) *operSeq {
+	return &operSeq{
+		maxOpers:      int32(max),
+		ranges:        cfg.probabilityRanges(),
+		sizes:         cfg.Sizes,
+		rng:           rand.New(rand.NewSource(seed)),
+		existingDirs:  newPathSet(),
+		existingFiles: newPathSet(),
+		existingLinks: newPathSet(),
+		aliases:       newAliasMap(),
+		sutcwd:        -1,
+		refcwd:        -1,
+	}
 }
 
 func (seq *operSeq) run(op *oper) error {
+	if !supported(op.code, filesystems) {
+		return fmt.Errorf("operSeq.run: %v not supported by the system under test", op.code)
+	}
+	atomic.StoreInt32(&currentOpID, int32(op.id))
+	before := op.beforeTimes(seq)
+	inodes := op.beforeInodes(seq)
+	unlinks := op.beforeUnlinks(seq)
+	seq.touchListings(op)
+	undo := op.undoer(seq)
+	sutUndo := op.sutUndoer()
 	op.run(seq)
+	atomic.StoreInt32(&currentOpID, -1)
+	if op.suterr != nil && op.referr == nil && op.expectedError() {
+		// Failed as expected on the system under test only, so the
+		// reference file system is made to look as if it had failed too.
+		if undo == nil {
+			return fmt.Errorf("operSeq.run: %v failed with %v as expected, but can't be undone on the reference", op.code, op.suterr)
+		}
+		if err := undo(); err != nil {
+			return fmt.Errorf("operSeq.run: undoing %v: %v", op.code, err)
+		}
+		op.referr = op.suterr
+	}
+	if op.suterr == nil && op.referr != nil && op.expectedError() {
+		// Likewise, the other way around.
+		if sutUndo == nil {
+			return fmt.Errorf("operSeq.run: %v failed with %v as expected on the reference, but can't be undone on the system under test", op.code, op.referr)
+		}
+		if err := sutUndo(); err != nil {
+			return fmt.Errorf("operSeq.run: undoing %v on the system under test: %v", op.code, err)
+		}
+		op.suterr = op.referr
+	}
 	logInfo("operSeq.run: op=%v", op)
+	if seq.trace != nil {
+		if err := seq.trace.write(op); err != nil {
+			return fmt.Errorf("operSeq.run: %v", err)
+		}
+	}
 	if err := op.outputsMatch(seq); err != nil {
-		return fmt.Errorf("operSeq.run %q: %v", op.code, err)
+		return fmt.Errorf("operSeq.run %q: %w", op.code, err)
+	}
+	if err := op.checkTimes(seq, before); err != nil {
+		return fmt.Errorf("operSeq.run %q: %w", op.code, err)
+	}
+	if err := op.checkStat(seq, inodes); err != nil {
+		return fmt.Errorf("operSeq.run %q: %w", op.code, err)
+	}
+	seq.unlinked(op, unlinks)
+	if seq.durableDir != "" && op.suterr == nil {
+		if err := seq.saveDurability(op); err != nil {
+			return fmt.Errorf("operSeq.run: %v", err)
+		}
 	}
+	seq.update(op)
+	atomic.AddInt32(&seq.opersDone, 1)
+	return nil
+}
+
+// Forgets about the file descriptors of the operation, closed.
+func (seq *operSeq) removeOpen(closed *oper) {
+	openOpers := make([]*oper, 0, len(seq.openOpers)-1)
+	for _, o := range seq.openOpers {
+		if o != closed {
+			openOpers = append(openOpers, o)
+		}
+	}
+	seq.openOpers = openOpers
+}
+
+// Bookkeeping after running an operation, based on the outcome on the
+// reference file system.
+func (seq *operSeq) update(op *oper) {
 	seq.mu.Lock()
 	defer seq.mu.Unlock()
-	// Bookkeeping:
 	switch op.code {
 	case operCreate, operOpen:
 		if op.referr == nil {
-			seq.existingFiles[op.pathname] = struct{}{}
+			seq.existingFiles.add(op.pathname)
+			seq.openOpers = append(seq.openOpers, op)
+		}
+	case operTmpfile, operDup:
+		if op.referr == nil {
+			if op.replaced != nil {
+				seq.removeOpen(op.replaced)
+			}
 			seq.openOpers = append(seq.openOpers, op)
 		}
 	case operSeek:
+		if op.referr == nil {
+			// Back to the start of a listing, or somewhere meaningless,
+			// for all file descriptors sharing the offset.
+			if d := op.parent.description(); op.offset == 0 && op.whence == io.SeekStart {
+				d.dir = nil
+			} else {
+				d.dir = &dirIter{skip: true}
+			}
+		}
 	case operRead:
 	case operWrite:
-	case operClose:
+	case operPread:
+	case operPwrite:
+	case operReadv:
+	case operWritev:
+	case operGetdents:
+	case operFsync, operFdatasync, operSyncfs:
+	case operMmap:
+		if op.referr == nil {
+			seq.mappedOpers = append(seq.mappedOpers, op)
+		}
+	case operMread:
+	case operMwrite:
+	case operMsync:
+	case operMunmap:
 		if op.referr == nil {
-			openOpers := make([]*oper, 0, len(seq.openOpers)-1)
-			for _, o := range seq.openOpers {
+			mappedOpers := make([]*oper, 0, len(seq.mappedOpers)-1)
+			for _, o := range seq.mappedOpers {
 				if o != op.parent {
-					openOpers = append(openOpers, o)
+					mappedOpers = append(mappedOpers, o)
 				}
 			}
-			seq.openOpers = openOpers
+			seq.mappedOpers = mappedOpers
+		}
+	case operClose:
+		if op.referr == nil {
+			seq.removeOpen(op.parent)
 		}
 	case operUnlink1:
 		if op.referr == nil {
-			delete(seq.existingFiles, op.pathname)
+			seq.existingFiles.remove(op.pathname)
+			seq.existingLinks.remove(op.pathname)
+			seq.aliases.remove(op.pathname)
 		}
 	case operUnlink2:
 		if op.referr == nil {
-			for d := range seq.existingDirs {
+			for _, d := range seq.existingDirs.list() {
 				if strings.HasPrefix(d, op.pathname) {
-					delete(seq.existingDirs, d)
+					seq.existingDirs.remove(d)
 				}
 			}
-			for f := range seq.existingFiles {
+			for _, f := range seq.existingFiles.list() {
 				if strings.HasPrefix(f, op.pathname) {
-					delete(seq.existingFiles, f)
+					seq.existingFiles.remove(f)
+					seq.aliases.remove(f)
+				}
+			}
+			for _, l := range seq.existingLinks.list() {
+				if strings.HasPrefix(l, op.pathname) {
+					seq.existingLinks.remove(l)
 				}
 			}
 		}
 	case operTruncate:
 	case operFtruncate:
+	case operFallocate:
 	case operMkdir:
 		if op.referr == nil {
-			seq.existingDirs[op.pathname] = struct{}{}
+			seq.existingDirs.add(op.pathname)
 		}
 	case operRmdir:
 		if op.referr == nil {
-			delete(seq.existingDirs, op.pathname)
+			seq.existingDirs.remove(op.pathname)
 		}
 	case operRename1:
 		if op.referr == nil {
-			if strings.HasPrefix(seq.cwdpath, op.pathname) {
-				prev := seq.cwdpath
-				seq.cwdpath = op.newpathname + seq.cwdpath[len(op.pathname):]
-				logDebug("changed cwdpath from %q to %q after rename1", prev, seq.cwdpath)
-			}
-			if _, ok := seq.existingDirs[op.pathname]; ok {
-				delete(seq.existingDirs, op.pathname)
-				seq.existingDirs[op.newpathname] = struct{}{}
-			}
-			if _, ok := seq.existingFiles[op.pathname]; ok {
-				delete(seq.existingFiles, op.pathname)
-				seq.existingFiles[op.newpathname] = struct{}{}
-			}
+			seq.movePaths(op.pathname, op.newpathname, false)
 		}
 	case operRename2:
 		if op.referr == nil {
@@ -106,27 +246,43 @@ func (seq *operSeq) run(op *oper) error {
 				seq.cwdpath = op.newpathname + seq.cwdpath[len(op.pathname):]
 			}
 			var tomove []string
-			for f := range seq.existingFiles {
+			for _, f := range seq.existingFiles.list() {
 				if strings.HasPrefix(f, op.pathname) {
 					tomove = append(tomove, f)
 				}
 			}
 			for _, f := range tomove {
 				newf := op.newpathname + f[len(op.pathname):]
-				delete(seq.existingFiles, f)
-				seq.existingFiles[newf] = struct{}{}
+				seq.existingFiles.remove(f)
+				seq.existingFiles.add(newf)
+				seq.aliases.rename(f, newf)
 			}
 			tomove = nil
-			for f := range seq.existingDirs {
+			for _, f := range seq.existingDirs.list() {
 				if strings.HasPrefix(f, op.pathname) {
 					tomove = append(tomove, f)
 				}
 			}
 			for _, f := range tomove {
 				newf := op.newpathname + f[len(op.pathname):]
-				delete(seq.existingDirs, f)
-				seq.existingDirs[newf] = struct{}{}
+				seq.existingDirs.remove(f)
+				seq.existingDirs.add(newf)
 			}
+			tomove = nil
+			for _, l := range seq.existingLinks.list() {
+				if strings.HasPrefix(l, op.pathname) {
+					tomove = append(tomove, l)
+				}
+			}
+			for _, l := range tomove {
+				newl := op.newpathname + l[len(op.pathname):]
+				seq.existingLinks.remove(l)
+				seq.existingLinks.add(newl)
+			}
+		}
+	case operRenameat2:
+		if op.referr == nil {
+			seq.movePaths(op.pathname, op.newpathname, op.rflags&unix.RENAME_EXCHANGE != 0)
 		}
 	case operChdir:
 		// -1 is okay as well, opencwds will be called later.
@@ -136,19 +292,151 @@ func (seq *operSeq) run(op *oper) error {
 			logDebug("updated cwdpath from %q to %q after chdir", seq.cwdpath, op.pathname)
 			seq.cwdpath = op.pathname
 		}
+	case operSymlink:
+		if op.referr == nil {
+			seq.existingLinks.add(op.pathname)
+		}
+	case operReadlink:
+	case operLstat:
+	case operStat:
+	case operFstat:
+	case operStatfs:
+	case operLink:
+		if op.referr == nil {
+			if seq.existingLinks.has(op.pathname) {
+				seq.existingLinks.add(op.newpathname)
+			} else {
+				seq.existingFiles.add(op.newpathname)
+			}
+			seq.aliases.link(op.pathname, op.newpathname)
+		}
+	case operFlink:
+		if op.referr == nil {
+			seq.existingFiles.add(op.newpathname)
+			// Files opened by name may have been renamed since.
+			d := op.parent.description()
+			if p := d.pathname; d.code != operTmpfile && seq.existingFiles.has(p) && !seq.existingLinks.has(p) {
+				seq.aliases.link(p, op.newpathname)
+			}
+		}
+	case operChmod:
+	case operFchmod:
+	case operFchmodat:
+	case operAccess:
+	case operUtimensat:
+	case operFutimens:
+	case operSetxattr:
+	case operGetxattr:
+	case operListxattr:
+	case operRemovexattr:
 	case operMuscleFlush:
 	case operMusclePush:
 	case operMuscleRemount:
 	case operMusclePruneCache:
 	case operMuscleTrim:
+	case operMuscleCrash:
+		// Done by operSeq.crash, based on the durable state.
 	case operSwapClients:
 	default:
-		logFatal("operSeq.run: unknown op code: %v", op.code)
+		logFatal("operSeq.update: unknown op code: %v", op.code)
+	}
+}
+
+// Rebuilds the sets of existing files, directories and links, and the
+// hard links among them, by walking the reference file system.
+func (seq *operSeq) rescan() error {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	seq.existingDirs = newPathSet()
+	seq.existingFiles = newPathSet()
+	seq.existingLinks = newPathSet()
+	seq.aliases = newAliasMap()
+	// The first name found for each inode with multiple links.
+	firsts := make(map[uint64]string)
+	err := filepath.Walk(refDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(refDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		switch {
+		case info.IsDir():
+			seq.existingDirs.add(rel)
+		case info.Mode()&os.ModeSymlink != 0:
+			seq.existingLinks.add(rel)
+		default:
+			seq.existingFiles.add(rel)
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && !info.IsDir() && st.Nlink > 1 {
+			if first, ok := firsts[st.Ino]; ok {
+				seq.aliases.link(first, rel)
+			} else {
+				firsts[st.Ino] = rel
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("operSeq.rescan: %v", err)
 	}
-	atomic.AddInt32(&seq.opersDone, 1)
 	return nil
 }
 
+// Moves the pathnames known at or under from to the same place under to,
+// which is replaced, after a rename, or, if exchange, swaps them with
+// those at or under to. Needs seq.mu held.
+func (seq *operSeq) movePaths(from, to string, exchange bool) {
+	// Renaming a link onto another link to the same file does nothing,
+	// exchanging them too.
+	if from == to || seq.aliases.same(from, to) {
+		return
+	}
+	move := func(p string) string {
+		switch {
+		case isUnder(p, from):
+			return to + p[len(from):]
+		case exchange && isUnder(p, to):
+			return from + p[len(to):]
+		default:
+			return p
+		}
+	}
+	if !exchange {
+		// A file, or an empty directory, so nothing is under it.
+		seq.aliases.remove(to)
+	}
+	seq.aliases.remap(move)
+	for _, s := range []*pathSet{seq.existingDirs, seq.existingFiles, seq.existingLinks} {
+		var moved []string
+		for _, p := range s.list() {
+			if q := move(p); q != p {
+				s.remove(p)
+				moved = append(moved, q)
+			}
+		}
+		if !exchange {
+			s.remove(to)
+		}
+		for _, q := range moved {
+			s.add(q)
+		}
+	}
+	if prev := seq.cwdpath; move(prev) != prev {
+		seq.cwdpath = move(prev)
+		logDebug("operSeq.movePaths: changed cwdpath from %q to %q", prev, seq.cwdpath)
+	}
+}
+
+// Reports whether the pathname is dir or names something under it.
+func isUnder(pathname, dir string) bool {
+	return pathname == dir || strings.HasPrefix(pathname, dir+"/")
+}
+
 var natoAlphabet = []string{
 	"alfa",
 	"bravo",
@@ -188,18 +476,12 @@ func (seq *operSeq) relativize(p string) string {
 }
 
 func (seq *operSeq) randomDir(maxElements int, existingProbability int) string {
-	if rand.Intn(100) < existingProbability {
-		if len(seq.existingDirs) == 0 {
+	if seq.rng.Intn(100) < existingProbability {
+		if seq.existingDirs.len() == 0 {
 			return ""
 		}
-		i := rand.Intn(len(seq.existingDirs))
-		j := 0
-		for f := range seq.existingDirs {
-			if j < i {
-				j++
-				continue
-			}
-			if len(strings.Split(f, "/")) <= maxElements {
+		for i := seq.rng.Intn(seq.existingDirs.len()); i < seq.existingDirs.len(); i++ {
+			if f := seq.existingDirs.at(i); len(strings.Split(f, "/")) <= maxElements {
 				return f
 			}
 		}
@@ -209,12 +491,10 @@ func (seq *operSeq) randomDir(maxElements int, existingProbability int) string {
 again:
 	elements := make([]string, maxElements)
 	for i := 0; i < maxElements; i++ {
-		elements[i] = natoAlphabet[rand.Intn(len(natoAlphabet))]
+		elements[i] = natoAlphabet[seq.rng.Intn(len(natoAlphabet))]
 	}
 	candidate := strings.Join(elements, "/")
-	_, ok1 := seq.existingFiles[candidate]
-	_, ok2 := seq.existingDirs[candidate]
-	if (ok1 || ok2) && attempts > 0 {
+	if (seq.existingFiles.has(candidate) || seq.existingDirs.has(candidate)) && attempts > 0 {
 		attempts--
 		goto again
 	}
@@ -222,18 +502,12 @@ again:
 }
 
 func (seq *operSeq) randomFile(maxElements int, existingProbability int) string {
-	if rand.Intn(100) < existingProbability {
-		if len(seq.existingFiles) == 0 {
+	if seq.rng.Intn(100) < existingProbability {
+		if seq.existingFiles.len() == 0 {
 			return ""
 		}
-		i := rand.Intn(len(seq.existingFiles))
-		j := 0
-		for f := range seq.existingFiles {
-			if j < i {
-				j++
-				continue
-			}
-			if len(strings.Split(f, "/")) <= maxElements {
+		for i := seq.rng.Intn(seq.existingFiles.len()); i < seq.existingFiles.len(); i++ {
+			if f := seq.existingFiles.at(i); len(strings.Split(f, "/")) <= maxElements {
 				return f
 			}
 		}
@@ -243,12 +517,10 @@ func (seq *operSeq) randomFile(maxElements int, existingProbability int) string
 again:
 	elements := make([]string, maxElements)
 	for i := 0; i < maxElements; i++ {
-		elements[i] = natoAlphabet[rand.Intn(len(natoAlphabet))]
+		elements[i] = natoAlphabet[seq.rng.Intn(len(natoAlphabet))]
 	}
 	candidate := strings.Join(elements, "/")
-	_, ok1 := seq.existingFiles[candidate]
-	_, ok2 := seq.existingDirs[candidate]
-	if (ok1 || ok2) && attempts > 0 {
+	if (seq.existingFiles.has(candidate) || seq.existingDirs.has(candidate)) && attempts > 0 {
 		attempts--
 		goto again
 	}
@@ -256,44 +528,152 @@ again:
 }
 
 func (seq *operSeq) randomPathname(existingDirProbability, existingFileProbability, nestingProbability int) string {
-	n := rand.Intn(100)
-	var m map[string]struct{}
+	n := seq.rng.Intn(100)
+	var m *pathSet
 	switch {
-	case 0 <= n && n < existingDirProbability && len(seq.existingDirs) > 0:
+	case 0 <= n && n < existingDirProbability && seq.existingDirs.len() > 0:
 		m = seq.existingDirs
-	case existingDirProbability <= n && n < existingDirProbability+existingFileProbability && len(seq.existingFiles) > 0:
+	case existingDirProbability <= n && n < existingDirProbability+existingFileProbability && seq.existingFiles.len() > 0:
 		m = seq.existingFiles
 	}
-	if len(m) > 0 {
-		i := rand.Int() % len(m)
-		j := 0
-		for p := range m {
-			if i == j {
-				return p
-			}
-			j++
-		}
+	if m != nil {
+		return m.at(seq.rng.Int() % m.len())
 	}
 	// If we're here, we want to generate a pathname that does not correspond to an existing file or directory.
 	// We may want to nest the directory structure.
-	if len(seq.existingDirs) > 0 && rand.Intn(100) < nestingProbability {
+	if seq.existingDirs.len() > 0 && seq.rng.Intn(100) < nestingProbability {
 		// We want to nest. Pick a random existing dir first:
-		i := rand.Intn(len(seq.existingDirs))
-		j := 0
-		var dir string
-		for dir = range seq.existingDirs {
-			if i == j {
-				break
+		dir := seq.existingDirs.at(seq.rng.Intn(seq.existingDirs.len()))
+		return filepath.Join(dir, natoAlphabet[seq.rng.Int()%len(natoAlphabet)])
+	}
+	return natoAlphabet[seq.rng.Int()%len(natoAlphabet)]
+}
+
+// With the given probability, and if there are any, returns an existing
+// symbolic link instead of the pathname.
+func (seq *operSeq) maybeLink(pathname string, probability int) string {
+	if seq.existingLinks.len() == 0 || seq.rng.Intn(100) >= probability {
+		return pathname
+	}
+	return seq.existingLinks.at(seq.rng.Intn(seq.existingLinks.len()))
+}
+
+// Returns a target for a new symbolic link: an existing node or a new
+// name (a dangling link) within the directory of the link, the link
+// itself (a loop), or another link in the same directory (a chain, or a
+// longer loop). Targets are relative and never go up, so that following
+// them can't escape the tree, wherever the link is.
+func (seq *operSeq) randomTarget(link string) string {
+	dir := filepath.Dir(link)
+	switch n := seq.rng.Intn(100); {
+	case n < 15:
+		return filepath.Base(link)
+	case n < 30:
+		var candidates []string
+		for _, l := range seq.existingLinks.list() {
+			if filepath.Dir(l) == dir && l != link {
+				candidates = append(candidates, filepath.Base(l))
 			}
-			j++
 		}
-		return filepath.Join(dir, natoAlphabet[rand.Int()%len(natoAlphabet)])
+		if len(candidates) > 0 {
+			return candidates[seq.rng.Intn(len(candidates))]
+		}
+	}
+	var candidates []string
+	for _, s := range []*pathSet{seq.existingDirs, seq.existingFiles} {
+		for _, p := range s.list() {
+			if dir == "." {
+				candidates = append(candidates, p)
+			} else if strings.HasPrefix(p, dir+"/") {
+				candidates = append(candidates, p[len(dir)+1:])
+			}
+		}
+	}
+	// 80% existing node, if any, else a new name.
+	if len(candidates) > 0 && seq.rng.Intn(100) < 80 {
+		return candidates[seq.rng.Intn(len(candidates))]
+	}
+	return natoAlphabet[seq.rng.Intn(len(natoAlphabet))]
+}
+
+// Returns random mode bits, 0777 half of the time, so that most
+// operations are allowed. The owner can always read, and search if the
+// mode may be for a directory, so that trees can be hashed and copied
+// without privileges.
+func (seq *operSeq) randomMode(searchable bool) uint32 {
+	if seq.rng.Intn(2) == 0 {
+		return 0777
+	}
+	mode := seq.rng.Uint32()&supportedModeBits | syscall.S_IRUSR
+	if searchable {
+		mode |= syscall.S_IXUSR
+	}
+	return mode
+}
+
+// Returns a random length for reads and writes: a multiple of the block
+// size, give or take one byte, so that writes end on, just before or
+// just after a block boundary, or else a small length half of the time,
+// as most writes are, or any length up to the configured number of
+// blocks.
+func (seq *operSeq) randomLength() int {
+	s := seq.sizes
+	if seq.rng.Intn(100) < s.BoundaryProbability {
+		n := seq.rng.Intn(s.MaxBlocks+1)*s.BlockSize + seq.rng.Intn(3) - 1
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+	if seq.rng.Intn(2) == 0 {
+		return seq.rng.Intn(512)
+	}
+	return seq.rng.Intn(s.MaxBlocks * s.BlockSize)
+}
+
+// Returns a random offset for seeks and positional I/O, or length for
+// truncation: sometimes anywhere up to the configured maximum, making
+// for sparse files, else as for randomLength, so that writes at block
+// boundaries or straddling them are common.
+func (seq *operSeq) randomOffset() int64 {
+	s := seq.sizes
+	if seq.rng.Intn(100) < s.SparseProbability {
+		return seq.rng.Int63n(s.MaxSparseOffset)
+	}
+	return int64(seq.randomLength())
+}
+
+// Returns a random time for utimensat and futimens: the current time 20%
+// of the time, no change 10% of the time, else a time before the run,
+// between 2000 and 2020, so that it can be told apart, cf. describeTime.
+func (seq *operSeq) randomTime() unix.Timespec {
+	switch n := seq.rng.Intn(10); {
+	case n < 2:
+		return unix.Timespec{Nsec: unix.UTIME_NOW}
+	case n < 3:
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	default:
+		return unix.Timespec{Sec: 946684800 + seq.rng.Int63n(20*365*24*3600), Nsec: seq.rng.Int63n(1e9)}
+	}
+}
+
+// Returns the name of an extended attribute in the user namespace, out
+// of a few, so that operations often find the attributes set earlier.
+func (seq *operSeq) randomXattr() string {
+	return "user." + natoAlphabet[seq.rng.Intn(4)]
+}
+
+// Like maybeLink, for names of files with other hard links.
+func (seq *operSeq) maybeAlias(pathname string, probability int) string {
+	linked := seq.aliases.linked
+	if linked.len() == 0 || seq.rng.Intn(100) >= probability {
+		return pathname
 	}
-	return natoAlphabet[rand.Int()%len(natoAlphabet)]
+	return linked.at(seq.rng.Intn(linked.len()))
 }
 
 func (seq *operSeq) randomOperKind() operKind {
-	n := int(rand.Float64() * 100.0)
+	n := int(seq.rng.Float64() * 100.0)
 	for _, r := range seq.ranges {
 		if n < r.upperBound {
 			return r.oper
@@ -307,10 +687,10 @@ func (seq *operSeq) opencwds() error {
 	if seq.sutcwd != -1 || seq.refcwd != -1 {
 		return fmt.Errorf("operSeq.opencwds: not both closed sutcwd=%d refcwd=%d", seq.sutcwd, seq.refcwd)
 	}
-	p := filepath.Join(filesystems[suti].mnt, seq.cwdpath)
+	p := filepath.Join(filesystems[suti].mountpoint(), seq.cwdpath)
 	logDebug("operSeq.opencwds: opening %seq as sut cwd", p)
 	// Cf. ../musl/src/dirent/opendir.c and ../musl/src/fcntl/open.c.
-	sutcwd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	sutcwd, err := sutClient().open(p, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
 	if err != nil {
 		return fmt.Errorf("operSeq.opencwds: opening %q: %w", p, err)
 	}
@@ -318,7 +698,7 @@ func (seq *operSeq) opencwds() error {
 	logDebug("operSeq.opencwds: opening %seq as ref cwd", p)
 	refcwd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
 	if err != nil {
-		_ = syscall.Close(sutcwd)
+		_ = sutClient().close(sutcwd)
 		return fmt.Errorf("operSeq.opencwds: opening %q: %w", p, err)
 	}
 	seq.sutcwd = sutcwd
@@ -332,7 +712,7 @@ func (seq *operSeq) closecwds() error {
 		logDebug("operSeq.closecwds: closing suti=%d sutcwd=%d", suti, seq.sutcwd)
 		fd := seq.sutcwd
 		seq.sutcwd = -1
-		if err := syscall.Close(fd); err != nil {
+		if err := sutClient().close(fd); err != nil {
 			return fmt.Errorf("operSeq.closecwds: %d: %v", fd, err)
 		}
 	}
@@ -353,63 +733,263 @@ func (seq *operSeq) nextOper() *oper {
 	if atomic.LoadInt32(&seq.opersDone) >= seq.maxOpers {
 		return nil
 	}
+	if seq.replay != nil {
+		return seq.replay[atomic.LoadInt32(&seq.opersDone)]
+	}
 again:
 	op := &oper{id: int(atomic.LoadInt32(&seq.opersDone)), code: seq.randomOperKind()}
 	switch op.code {
 	case operCreate:
-		// op.mode = rand.Uint32() & supportedModeBits
-		op.mode = 0777
+		op.mode = seq.randomMode(false)
 		// 5% existing directory, 5% existing file, 90% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(5, 5, 20)
 	case operOpen:
-		op.flags = randomOpenFlags()
+		op.flags = randomOpenFlags(seq.rng)
 		// Cf. ../musl/src/fcntl/open.c.
 		if op.flags&syscall.O_CREAT != 0 || op.flags&unix.O_TMPFILE == unix.O_TMPFILE {
-			// op.mode = rand.Uint32() & supportedModeBits
-			op.mode = 0777
+			op.mode = seq.randomMode(false)
 		}
 		// 25% existing directory, 65% existing file, 10% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(25, 65, 20)
+		// Half of the directories as opendir(3) does, else most fail
+		// with EISDIR, to have some to list.
+		if seq.existingDirs.has(op.pathname) && seq.rng.Intn(2) == 0 {
+			op.flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_CLOEXEC
+			op.mode = 0
+		}
+		// Links may dangle or loop, and matter to O_NOFOLLOW.
+		op.pathname = seq.maybeLink(op.pathname, 15)
+		// Writes through a name must show through the others.
+		op.pathname = seq.maybeAlias(op.pathname, 15)
+	case operTmpfile:
+		// Mostly writable, as O_TMPFILE requires, and sometimes with
+		// O_EXCL, so that the file can't be linked.
+		op.flags = syscall.O_RDWR
+		switch seq.rng.Intn(20) {
+		case 0:
+			op.flags = syscall.O_RDONLY
+		case 1, 2, 3, 4:
+			op.flags = syscall.O_WRONLY
+		}
+		if seq.rng.Intn(5) == 0 {
+			op.flags |= syscall.O_EXCL
+		}
+		op.flags |= unix.O_TMPFILE | syscall.O_CLOEXEC
+		op.mode = seq.randomMode(false)
+		// 80% existing directory, 10% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(80, 10, 20)
+	case operDup:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from dup")
+			goto again
+		}
+		// Duplicates of duplicates too, all sharing the offset.
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		switch seq.rng.Intn(4) {
+		case 0:
+			op.cmd = cmdDup
+		case 1:
+			op.cmd = unix.F_DUPFD
+		case 2:
+			op.cmd = unix.F_DUPFD_CLOEXEC
+		case 3:
+			// Onto another open file, or the same file descriptor, which
+			// fails, as do flags other than O_CLOEXEC.
+			op.cmd = cmdDup3
+			op.replaced = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+			switch n := seq.rng.Intn(10); {
+			case n < 5:
+				op.flags = unix.O_CLOEXEC
+			case n < 9:
+				op.flags = 0
+			default:
+				op.flags = unix.O_NONBLOCK
+			}
+		}
+	case operMmap:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from mmap")
+			goto again
+		}
+		// Mostly files open for reading and writing, as shared writable
+		// mappings need, if any.
+		var rdwr []*oper
+		for _, o := range seq.openOpers {
+			if o.description().flags&syscall.O_ACCMODE == syscall.O_RDWR {
+				rdwr = append(rdwr, o)
+			}
+		}
+		if len(rdwr) > 0 && seq.rng.Intn(10) != 0 {
+			op.parent = rdwr[seq.rng.Intn(len(rdwr))]
+		} else {
+			op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		}
+		op.length = seq.randomLength()
+		op.refmapfd = -1
+		// Mostly from the start, else from a page, possibly past the end
+		// of the file, rarely from anywhere, which fails.
+		switch n := seq.rng.Intn(10); {
+		case n < 7:
+			op.offset = 0
+		case n < 9:
+			op.offset = seq.randomOffset() / pageSize * pageSize
+		default:
+			op.offset = seq.randomOffset()
+		}
+	case operMread, operMwrite:
+		if len(seq.mappedOpers) == 0 {
+			logDebug("again from %v", op.code)
+			goto again
+		}
+		op.parent = seq.mappedOpers[seq.rng.Intn(len(seq.mappedOpers))]
+		// Mostly within the first page, which the file backs unless empty,
+		// else anywhere within the mapping, which may extend past the end
+		// of the file, which writes stop at, see mappedLength.
+		l := op.parent.length
+		if l > int(pageSize) && seq.rng.Intn(2) == 0 {
+			l = int(pageSize)
+		}
+		op.offset = int64(seq.rng.Intn(l + 1))
+		n := seq.rng.Intn(l - int(op.offset) + 1)
+		if op.code == operMread {
+			op.rbuf = n
+		} else {
+			op.wbuf = make([]byte, mappedLength(op.parent, op.offset, n))
+			seq.rng.Read(op.wbuf)
+		}
+	case operMsync:
+		if len(seq.mappedOpers) == 0 {
+			logDebug("again from msync")
+			goto again
+		}
+		op.parent = seq.mappedOpers[seq.rng.Intn(len(seq.mappedOpers))]
+		switch n := seq.rng.Intn(10); {
+		case n < 5:
+			op.msflags = unix.MS_SYNC
+		case n < 8:
+			op.msflags = unix.MS_ASYNC
+		case n < 9:
+			op.msflags = unix.MS_SYNC | unix.MS_INVALIDATE
+		default:
+			op.msflags = unix.MS_ASYNC | unix.MS_INVALIDATE
+		}
+	case operMunmap:
+		if len(seq.mappedOpers) == 0 {
+			logDebug("again from munmap")
+			goto again
+		}
+		op.parent = seq.mappedOpers[seq.rng.Intn(len(seq.mappedOpers))]
 	case operSeek:
 		if len(seq.openOpers) == 0 {
 			logDebug("again from seek")
 			goto again
 		}
-		op.parent = seq.openOpers[rand.Intn(len(seq.openOpers))]
-		op.offset = int64(rand.Intn(1024))
-		switch rand.Intn(3) {
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.offset = seq.randomOffset()
+		// Only regular files have data and holes, cf. checkHoles.
+		n := 5
+		if d := op.parent.description(); d.flags&unix.O_TMPFILE != unix.O_TMPFILE && (d.flags&syscall.O_DIRECTORY != 0 || seq.existingDirs.has(d.pathname)) {
+			n = 3
+		}
+		switch seq.rng.Intn(n) {
 		case 0:
 			op.whence = io.SeekStart
 		case 1:
 			op.whence = io.SeekCurrent
 		case 2:
 			op.whence = io.SeekEnd
+		case 3:
+			op.whence = seekData
+		case 4:
+			op.whence = seekHole
 		}
 	case operRead:
 		if len(seq.openOpers) == 0 {
 			logDebug("again from read")
 			goto again
 		}
-		op.parent = seq.openOpers[rand.Intn(len(seq.openOpers))]
-		op.rbuf = rand.Intn(512)
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.rbuf = seq.randomLength()
 	case operWrite:
 		if len(seq.openOpers) == 0 {
 			logDebug("again from write")
 			goto again
 		}
-		op.parent = seq.openOpers[rand.Intn(len(seq.openOpers))]
-		sz := rand.Intn(512)
-		op.wbuf = make([]byte, sz)
-		rand.Read(op.wbuf)
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.wbuf = make([]byte, seq.randomLength())
+		seq.rng.Read(op.wbuf)
+	case operPread, operPwrite:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from %v", op.code)
+			goto again
+		}
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		// Sometimes negative, which is invalid.
+		op.offset = seq.randomOffset()
+		if seq.rng.Intn(20) == 0 {
+			op.offset = -op.offset - 1
+		}
+		if op.code == operPread {
+			op.rbuf = seq.randomLength()
+		} else {
+			op.wbuf = make([]byte, seq.randomLength())
+			seq.rng.Read(op.wbuf)
+		}
+	case operReadv, operWritev:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from %v", op.code)
+			goto again
+		}
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		// Up to 4 buffers, possibly empty.
+		op.iov = make([]int, 1+seq.rng.Intn(4))
+		size := 0
+		for i := range op.iov {
+			op.iov[i] = seq.rng.Intn(128)
+			size += op.iov[i]
+		}
+		if op.code == operWritev {
+			op.wbuf = make([]byte, size)
+			seq.rng.Read(op.wbuf)
+		}
+	case operGetdents:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from getdents")
+			goto again
+		}
+		// Mostly directories, if any are open, else there's nothing to list.
+		var dirs []*oper
+		for _, o := range seq.openOpers {
+			if o.description().flags&syscall.O_DIRECTORY != 0 {
+				dirs = append(dirs, o)
+			}
+		}
+		if len(dirs) > 0 && seq.rng.Intn(10) != 0 {
+			op.parent = dirs[seq.rng.Intn(len(dirs))]
+		} else {
+			op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		}
+		// Mostly a few entries at a time, so that other operations
+		// happen while listing.
+		op.rbuf = minDirentBuf + seq.rng.Intn(64)
+		if seq.rng.Intn(4) == 0 {
+			op.rbuf = minDirentBuf + seq.rng.Intn(4096)
+		}
+	case operFsync, operFdatasync, operSyncfs:
+		// 20% the cwd, else an open file, if any.
+		if len(seq.openOpers) > 0 && seq.rng.Intn(5) != 0 {
+			op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		}
 	case operClose:
 		if len(seq.openOpers) == 0 {
 			logDebug("again from close")
 			goto again
 		}
-		op.parent = seq.openOpers[rand.Intn(len(seq.openOpers))]
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
 	case operUnlink1:
 		// 25% existing directory, 65% existing file, 10% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(25, 65, 20)
+		op.pathname = seq.maybeLink(op.pathname, 15)
 	case operUnlink2:
 		// 50% existing directory, 40% existing file, 10% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(50, 40, 20)
@@ -422,24 +1002,43 @@ again:
 	case operTruncate:
 		// 10% existing directory, 70% existing file, 20% new node, 50% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(10, 70, 50)
-		op.rbuf = rand.Intn(512)
+		op.pathname = seq.maybeLink(op.pathname, 15)
+		op.rbuf = int(seq.randomOffset())
 	case operFtruncate:
 		if len(seq.openOpers) == 0 {
 			logDebug("again from ftruncate")
 			goto again
 		}
-		op.parent = seq.openOpers[rand.Intn(len(seq.openOpers))]
-		op.rbuf = rand.Intn(512)
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.rbuf = int(seq.randomOffset())
+	case operFallocate:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from fallocate")
+			goto again
+		}
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.offset = seq.randomOffset()
+		op.length = seq.randomLength()
+		// Sometimes invalid, as punching a hole must keep the size.
+		switch n := seq.rng.Intn(100); {
+		case n < 40:
+			op.mode = 0
+		case n < 70:
+			op.mode = unix.FALLOC_FL_KEEP_SIZE
+		case n < 95:
+			op.mode = unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+		default:
+			op.mode = unix.FALLOC_FL_PUNCH_HOLE
+		}
 	case operMkdir:
-		// op.mode = rand.Uint32() & supportedmodebits
-		op.mode = 0777
+		op.mode = seq.randomMode(true)
 		// 10% existing directory, 10% existing file, 80% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(10, 10, 20)
 	case operRmdir:
 		// 65% existing directory, 15% existing file, 20% new node, 20% chance of nesting in the latter case.
 		op.pathname = seq.randomPathname(65, 15, 20)
 	case operRename1:
-		if rand.Intn(2) == 0 {
+		if seq.rng.Intn(2) == 0 {
 			op.pathname = seq.randomDir(5, 75) // max 4 levels deep, 75% existing directory
 		} else {
 			op.pathname = seq.randomFile(5, 75) // max 4 levels deep, 75% existing file
@@ -448,11 +1047,32 @@ again:
 			logDebug("again from rename1")
 			goto again
 		}
-		newname := natoAlphabet[rand.Intn(len(natoAlphabet))]
+		op.pathname = seq.maybeLink(op.pathname, 15)
+		newname := natoAlphabet[seq.rng.Intn(len(natoAlphabet))]
 		op.newpathname = filepath.Join(filepath.Dir(op.pathname), newname)
 		logDebug("operSeq.nextOper: rename1 %q %q", op.pathname, op.newpathname)
+	case operRenameat2:
+		// 40% existing directory, 50% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.maybeLink(seq.randomPathname(40, 50, 20), 10)
+		switch n := seq.rng.Intn(100); {
+		case n < 10:
+			// Into itself, which fails.
+			op.newpathname = filepath.Join(op.pathname, natoAlphabet[seq.rng.Intn(len(natoAlphabet))])
+		case n < 20:
+			// Within the same directory.
+			op.newpathname = filepath.Join(filepath.Dir(op.pathname), natoAlphabet[seq.rng.Intn(len(natoAlphabet))])
+		default:
+			// 30% existing directory, possibly not empty, 30% existing file, 40% new node, 60% chance of nesting in the latter case.
+			op.newpathname = seq.randomPathname(30, 30, 60)
+		}
+		switch n := seq.rng.Intn(4); n {
+		case 0:
+			op.rflags = unix.RENAME_NOREPLACE
+		case 1:
+			op.rflags = unix.RENAME_EXCHANGE
+		}
 	case operRename2:
-		switch rand.Intn(4) {
+		switch seq.rng.Intn(4) {
 		case 0:
 			op.pathname = seq.randomFile(3, 75)    // at most 2 levels deep, 75% existing file
 			op.newpathname = seq.randomFile(3, 75) // at most 2 levels deep, 75% existing file
@@ -489,11 +1109,128 @@ again:
 			goto again
 		}
 		op.pathname = dir
+	case operSymlink:
+		// 5% existing directory, 10% existing file, 85% new node, 60% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(5, 10, 60)
+		op.target = seq.randomTarget(op.pathname)
+	case operReadlink:
+		// 70% existing link, else 20% existing directory, 40% existing file, 40% new node.
+		op.pathname = seq.maybeLink(seq.randomPathname(20, 40, 20), 70)
+		// Small buffers, to exercise truncation of the target.
+		op.rbuf = seq.rng.Intn(64)
+	case operLstat:
+		// 50% existing link, else 30% existing directory, 50% existing file, 20% new node.
+		op.pathname = seq.maybeLink(seq.randomPathname(30, 50, 20), 50)
+		op.pathname = seq.maybeAlias(op.pathname, 20)
+	case operStat:
+		// 30% existing link, else 30% existing directory, 50% existing file, 20% new node.
+		op.pathname = seq.maybeLink(seq.randomPathname(30, 50, 20), 30)
+		op.pathname = seq.maybeAlias(op.pathname, 20)
+	case operFstat:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from fstat")
+			goto again
+		}
+		// Possibly unlinked since.
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+	case operStatfs:
+		// 30% existing directory, 50% existing file, 20% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.maybeLink(seq.randomPathname(30, 50, 20), 10)
+	case operLink:
+		// 30% file with other links, else 10% existing directory, 80% existing file, 10% new node.
+		op.pathname = seq.maybeAlias(seq.randomPathname(10, 80, 20), 30)
+		// 5% existing directory, 10% existing file, 85% new node, 60% chance of nesting in the latter case.
+		op.newpathname = seq.randomPathname(5, 10, 60)
+	case operFlink:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from flink")
+			goto again
+		}
+		// Mostly files with no name yet, if any are open.
+		var tmpfiles []*oper
+		for _, o := range seq.openOpers {
+			if o.description().code == operTmpfile {
+				tmpfiles = append(tmpfiles, o)
+			}
+		}
+		if len(tmpfiles) > 0 && seq.rng.Intn(5) != 0 {
+			op.parent = tmpfiles[seq.rng.Intn(len(tmpfiles))]
+		} else {
+			op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		}
+		op.atflags = unix.AT_EMPTY_PATH
+		if seq.rng.Intn(2) == 0 {
+			op.atflags = unix.AT_SYMLINK_FOLLOW
+		}
+		// 5% existing directory, 10% existing file, 85% new node, 60% chance of nesting in the latter case.
+		op.newpathname = seq.randomPathname(5, 10, 60)
+	case operChmod, operFchmodat:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(30, 60, 20)
+		op.pathname = seq.maybeLink(op.pathname, 10)
+		// It may be a directory, e.g., through a link.
+		op.mode = seq.randomMode(true)
+	case operFchmod:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from fchmod")
+			goto again
+		}
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.mode = seq.randomMode(true)
+	case operAccess:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(30, 60, 20)
+		if seq.rng.Intn(4) == 0 {
+			op.mode = unix.F_OK
+		} else {
+			op.mode = uint32(seq.rng.Intn(8))
+		}
+	case operUtimensat:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.randomPathname(30, 60, 20)
+		op.pathname = seq.maybeLink(op.pathname, 20)
+		op.times = []unix.Timespec{seq.randomTime(), seq.randomTime()}
+		if seq.rng.Intn(4) == 0 {
+			op.atflags = unix.AT_SYMLINK_NOFOLLOW
+		}
+	case operFutimens:
+		if len(seq.openOpers) == 0 {
+			logDebug("again from futimens")
+			goto again
+		}
+		op.parent = seq.openOpers[seq.rng.Intn(len(seq.openOpers))]
+		op.times = []unix.Timespec{seq.randomTime(), seq.randomTime()}
+	case operSetxattr:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.maybeLink(seq.randomPathname(30, 60, 20), 10)
+		op.xattr = seq.randomXattr()
+		op.wbuf = make([]byte, seq.rng.Intn(64))
+		seq.rng.Read(op.wbuf)
+		switch seq.rng.Intn(5) {
+		case 0:
+			op.xflags = unix.XATTR_CREATE
+		case 1:
+			op.xflags = unix.XATTR_REPLACE
+		}
+	case operGetxattr, operListxattr, operRemovexattr:
+		// 30% existing directory, 60% existing file, 10% new node, 20% chance of nesting in the latter case.
+		op.pathname = seq.maybeLink(seq.randomPathname(30, 60, 20), 10)
+		if op.code != operListxattr {
+			op.xattr = seq.randomXattr()
+		}
+		if op.code != operRemovexattr {
+			// Querying the size 20% of the time, else small buffers, to
+			// exercise ERANGE.
+			if seq.rng.Intn(5) != 0 {
+				op.rbuf = 1 + seq.rng.Intn(80)
+			}
+		}
 	case operMuscleFlush:
 	case operMusclePush:
 	case operMuscleRemount:
 	case operMusclePruneCache:
 	case operMuscleTrim:
+	case operMuscleCrash:
 	case operSwapClients:
 	default:
 		panic(fmt.Sprintf("unknown op code: %v", op.code))
@@ -504,9 +1241,12 @@ again:
 func (seq *operSeq) closeAll() error {
 	seq.mu.Lock()
 	defer seq.mu.Unlock()
+	if err := seq.unmapAll(); err != nil {
+		return fmt.Errorf("operSeq.closeAll: %v", err)
+	}
 	for _, f := range seq.openOpers {
 		if f.sutfd != -1 {
-			if err := syscall.Close(f.sutfd); err != nil {
+			if err := sutClient().close(f.sutfd); err != nil {
 				return fmt.Errorf("operSeq.closeAll: %v", err)
 			}
 		}
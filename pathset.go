@@ -0,0 +1,139 @@
+package main
+
+// A pathSet is a set of pathnames that keeps its elements in a slice,
+// so that iterating over it, and picking random elements from it,
+// doesn't depend on the randomized order of Go maps.
+type pathSet struct {
+	index map[string]int
+	paths []string
+}
+
+func newPathSet() *pathSet {
+	return &pathSet{index: make(map[string]int)}
+}
+
+func (s *pathSet) add(p string) {
+	if _, ok := s.index[p]; ok {
+		return
+	}
+	s.index[p] = len(s.paths)
+	s.paths = append(s.paths, p)
+}
+
+// Removes the pathname by moving the last one in its place.
+func (s *pathSet) remove(p string) {
+	i, ok := s.index[p]
+	if !ok {
+		return
+	}
+	last := s.paths[len(s.paths)-1]
+	s.paths[i] = last
+	s.index[last] = i
+	s.paths = s.paths[:len(s.paths)-1]
+	delete(s.index, p)
+}
+
+func (s *pathSet) has(p string) bool {
+	_, ok := s.index[p]
+	return ok
+}
+
+func (s *pathSet) len() int {
+	return len(s.paths)
+}
+
+func (s *pathSet) at(i int) string {
+	return s.paths[i]
+}
+
+// Returns a copy of the pathnames, safe to use while modifying the set.
+func (s *pathSet) list() []string {
+	return append([]string(nil), s.paths...)
+}
+
+// An aliasMap groups the names known to be hard links to the same file.
+// Names in no group are the only link to their file, as far as we know.
+type aliasMap struct {
+	// Maps each name to its group, shared by all names in it.
+	groups map[string]*pathSet
+	// All names in groups, for picking one at random.
+	linked *pathSet
+}
+
+func newAliasMap() *aliasMap {
+	return &aliasMap{groups: make(map[string]*pathSet), linked: newPathSet()}
+}
+
+// Records that newname is a new link to the file named oldname.
+func (m *aliasMap) link(oldname, newname string) {
+	g, ok := m.groups[oldname]
+	if !ok {
+		g = newPathSet()
+		g.add(oldname)
+		m.groups[oldname] = g
+		m.linked.add(oldname)
+	}
+	g.add(newname)
+	m.groups[newname] = g
+	m.linked.add(newname)
+}
+
+func (m *aliasMap) remove(name string) {
+	g, ok := m.groups[name]
+	if !ok {
+		return
+	}
+	g.remove(name)
+	delete(m.groups, name)
+	m.linked.remove(name)
+	if g.len() == 1 {
+		last := g.at(0)
+		delete(m.groups, last)
+		m.linked.remove(last)
+	}
+}
+
+// Renames all names through f, which maps different names to different
+// ones, e.g., after a directory is moved.
+func (m *aliasMap) remap(f func(string) string) {
+	seen := make(map[*pathSet]bool)
+	var groups [][]string
+	for _, name := range m.linked.list() {
+		g := m.groups[name]
+		if !seen[g] {
+			seen[g] = true
+			groups = append(groups, g.list())
+		}
+	}
+	*m = *newAliasMap()
+	for _, g := range groups {
+		for _, name := range g[1:] {
+			m.link(f(g[0]), f(name))
+		}
+	}
+}
+
+// Reports whether the names are known to be links to the same file.
+func (m *aliasMap) same(a, b string) bool {
+	g, ok := m.groups[a]
+	return ok && g == m.groups[b]
+}
+
+// Records a rename, which replaces newname if it exists, unless it's a
+// link to the same file, in which case rename(2) does nothing.
+func (m *aliasMap) rename(oldname, newname string) {
+	if oldname == newname || m.same(oldname, newname) {
+		return
+	}
+	m.remove(newname)
+	g, ok := m.groups[oldname]
+	if !ok {
+		return
+	}
+	g.remove(oldname)
+	g.add(newname)
+	delete(m.groups, oldname)
+	m.groups[newname] = g
+	m.linked.remove(oldname)
+	m.linked.add(newname)
+}
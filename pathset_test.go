@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAliasMapRenameOntoAliasKeepsBoth(t *testing.T) {
+	m := newAliasMap()
+	m.link("alfa", "bravo")
+	m.rename("alfa", "bravo")
+	if m.groups["alfa"] == nil || m.groups["alfa"] != m.groups["bravo"] {
+		t.Errorf("got alfa and bravo no longer aliases, want rename(2) to do nothing")
+	}
+	if got := m.linked.len(); got != 2 {
+		t.Errorf("got %d linked names, want 2", got)
+	}
+}
+
+func TestMovePathsOntoAliasDoesNothing(t *testing.T) {
+	seq := &operSeq{aliases: newAliasMap(), existingDirs: newPathSet(), existingFiles: newPathSet(), existingLinks: newPathSet()}
+	seq.existingFiles.add("alfa")
+	seq.existingFiles.add("bravo")
+	seq.aliases.link("alfa", "bravo")
+	seq.movePaths("alfa", "bravo", false)
+	if !seq.existingFiles.has("alfa") || !seq.existingFiles.has("bravo") {
+		t.Errorf("got files %v, want both alfa and bravo", seq.existingFiles.list())
+	}
+	if !seq.aliases.same("alfa", "bravo") {
+		t.Error("got alfa and bravo no longer aliases")
+	}
+}
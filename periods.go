@@ -7,22 +7,33 @@ import (
 )
 
 // Represents how often hashing of fs metadata and fs contents
-// happens, where the unit of time is the operation count.
+// happens, where the unit of time is the operation count. Hashing
+// timestamps too is optional, cf. describeTime.
 type hashPeriods struct {
 	hashMetadata int
 	hashContents int
+	// Zero if never.
+	hashTimes int
 }
 
 // String implements fmt.Stringer and flag.Value.
 func (p *hashPeriods) String() string {
-	return fmt.Sprintf("{metadata=%d,contents=%d}", p.hashMetadata, p.hashContents)
+	return fmt.Sprintf("{metadata=%d,contents=%d,times=%d}", p.hashMetadata, p.hashContents, p.hashTimes)
+}
+
+// Reports what to hash after the operation with the given id.
+func (p *hashPeriods) at(id int) (includeMeta, includeContent, includeTimes bool) {
+	includeMeta = id%p.hashMetadata == 0
+	includeContent = id%p.hashContents == 0
+	includeTimes = p.hashTimes > 0 && id%p.hashTimes == 0
+	return
 }
 
 // Set implements flag.Value.
 func (p *hashPeriods) Set(s string) error {
 	parts := strings.Split(s, ",")
-	if l := len(parts); l != 2 {
-		return fmt.Errorf("too many tokens (%d), want 2 comma-separated ints", l)
+	if l := len(parts); l != 2 && l != 3 {
+		return fmt.Errorf("wrong number of tokens (%d), want 2 or 3 comma-separated ints", l)
 	}
 	metadata, err := strconv.Atoi(parts[0])
 	if err != nil {
@@ -38,7 +49,18 @@ func (p *hashPeriods) Set(s string) error {
 	if contents%metadata != 0 {
 		return fmt.Errorf("the contents period must be a multiple of the metadata period")
 	}
+	times := 0
+	if len(parts) == 3 {
+		times, err = strconv.Atoi(parts[2])
+		if err != nil {
+			return err
+		}
+		if times < 0 || times%metadata != 0 {
+			return fmt.Errorf("the times period must be a multiple of the metadata period, or 0")
+		}
+	}
 	p.hashMetadata = metadata
 	p.hashContents = contents
+	p.hashTimes = times
 	return nil
 }
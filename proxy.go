@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+)
+
+// The id of the operation being run, logged with the 9P messages it
+// causes, or -1 between operations.
+var currentOpID int32 = -1
+
+// A ninepProxy sits between a 9P client, e.g., the Linux 9p driver, and
+// a 9P server listening on a Unix socket, and logs every message
+// exchanged.
+type ninepProxy struct {
+	listener net.Listener
+	upstream string
+
+	mu  sync.Mutex
+	log *os.File
+}
+
+// Starts a proxy listening on socket and forwarding to upstream, which
+// needn't be listening yet, and logging messages to logPath.
+func startNinepProxy(socket, upstream, logPath string) (*ninepProxy, error) {
+	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("startNinepProxy: %v", err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("startNinepProxy: %v", err)
+	}
+	proxy := &ninepProxy{listener: l, upstream: upstream, log: f}
+	go proxy.serve()
+	return proxy, nil
+}
+
+func (proxy *ninepProxy) serve() {
+	for conn := 0; ; conn++ {
+		down, err := proxy.listener.Accept()
+		if err != nil {
+			// Closed.
+			return
+		}
+		up, err := net.Dial("unix", proxy.upstream)
+		if err != nil {
+			logError("ninepProxy.serve: %v", err)
+			_ = down.Close()
+			continue
+		}
+		s := &proxySession{proxy: proxy, conn: conn, sent: make(map[uint16]time.Time)}
+		go s.forward(down, up, "->")
+		go s.forward(up, down, "<-")
+	}
+}
+
+func (proxy *ninepProxy) close() error {
+	err := proxy.listener.Close()
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	if err2 := proxy.log.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (proxy *ninepProxy) logf(format string, a ...interface{}) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	_, _ = fmt.Fprintf(proxy.log, format, a...)
+}
+
+// The messages of one client connection.
+type proxySession struct {
+	proxy *ninepProxy
+	conn  int
+
+	mu   sync.Mutex
+	dotu bool
+	// When each outstanding T-message was sent, by tag.
+	sent map[uint16]time.Time
+}
+
+// Copies messages from src to dst until either fails, then closes both.
+func (s *proxySession) forward(src, dst net.Conn, direction string) {
+	defer func() {
+		_ = src.Close()
+		_ = dst.Close()
+	}()
+	r := bufio.NewReader(src)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.LittleEndian.Uint32(size[:]))
+		if len(msg) < 7 {
+			s.proxy.logf("%s conn=%d %s bad message size %d\n", time.Now().Format(time.RFC3339Nano), s.conn, direction, len(msg))
+			return
+		}
+		copy(msg, size[:])
+		if _, err := io.ReadFull(r, msg[len(size):]); err != nil {
+			return
+		}
+		s.record(msg, direction)
+		if _, err := dst.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (s *proxySession) record(msg []byte, direction string) {
+	now := time.Now()
+	op := atomic.LoadInt32(&currentOpID)
+	s.mu.Lock()
+	fc, err, _ := p.Unpack(msg, s.dotu)
+	var latency string
+	if err == nil {
+		if fc.Type%2 == 0 {
+			s.sent[fc.Tag] = now
+		} else if t, ok := s.sent[fc.Tag]; ok {
+			latency = fmt.Sprintf(" (%v)", now.Sub(t))
+			delete(s.sent, fc.Tag)
+		}
+		if fc.Type == p.Rversion {
+			s.dotu = strings.HasPrefix(fc.Version, "9P2000.u")
+		}
+	}
+	s.mu.Unlock()
+	var desc string
+	if err != nil {
+		// E.g., 9P2000.L messages, which the p package doesn't know about.
+		desc = fmt.Sprintf("type %d size %d: %v", msg[4], len(msg), err)
+	} else {
+		desc = fc.String()
+	}
+	s.proxy.logf("%s conn=%d op=%d %s %s%s\n", now.Format(time.RFC3339Nano), s.conn, op, direction, desc, latency)
+}
+
+// Returns the last n lines of the file at path.
+func tailLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("tailLines: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("tailLines: %v", err)
+	}
+	return lines, nil
+}
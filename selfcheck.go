@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// Generates a sequence of operations without running them. The
+// bookkeeping is done as if every operation succeeded.
+func generateOpers(max int, seed int64, cfg *config) []*oper {
+	seq := newOperSeq(max, cfg, seed)
+	var ops []*oper
+	for {
+		op := seq.nextOper()
+		if op == nil {
+			return ops
+		}
+		seq.update(op)
+		atomic.AddInt32(&seq.opersDone, 1)
+		ops = append(ops, op)
+	}
+}
+
+// Checks that the same seed and configuration give the same operations.
+func checkDeterminism(max int, seed int64, cfg *config) error {
+	first := generateOpers(max, seed, cfg)
+	second := generateOpers(max, seed, cfg)
+	if len(first) != len(second) {
+		return fmt.Errorf("checkDeterminism: generated %d and %d operations", len(first), len(second))
+	}
+	for i := range first {
+		a, err := json.Marshal(first[i].record())
+		if err != nil {
+			return fmt.Errorf("checkDeterminism: %v", err)
+		}
+		b, err := json.Marshal(second[i].record())
+		if err != nil {
+			return fmt.Errorf("checkDeterminism: %v", err)
+		}
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("checkDeterminism: operation %d differs: %s vs %s", i, a, b)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratedOpersAreDeterministic(t *testing.T) {
+	cfg, err := loadConfig(strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seed := int64(0); seed < 10; seed++ {
+		if err := checkDeterminism(500, seed, cfg); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Runs the operations against fresh file systems and returns the
+// operations actually run (copies of the given ones, outputs included)
+// and the resulting failure, if any.
+func replayOnce(ops []*oper, spec string, periods hashPeriods, cfg *config) ([]*oper, error) {
+	if err := beforeAll(spec); err != nil {
+		logFatal("replayOnce: %v", err)
+	}
+	defer afterAll()
+	clones := cloneOpers(ops)
+	err := runOperations(0, 0, periods, cfg, clones)
+	var mismatch *mismatchError
+	if errors.As(err, &mismatch) {
+		for i, op := range clones {
+			if op.id == mismatch.id {
+				return clones[:i+1], err
+			}
+		}
+	}
+	return clones, err
+}
+
+// Returns the operations left after removing those in ops[start:end]
+// and all those whose parent, or replaced operation, has been removed,
+// directly or not.
+func withoutRange(ops []*oper, start, end int) []*oper {
+	removed := make(map[*oper]bool)
+	var kept []*oper
+	for i, op := range ops {
+		if (start <= i && i < end) || (op.parent != nil && removed[op.parent]) || (op.replaced != nil && removed[op.replaced]) {
+			removed[op] = true
+			continue
+		}
+		kept = append(kept, op)
+	}
+	return kept
+}
+
+// Minimizes a failing operation sequence, using a simplified version
+// of delta debugging: the sequence is split in n chunks, and each
+// chunk is removed in turn; if the remaining operations still fail
+// with the same signature, they become the new sequence, else the
+// granularity is increased.
+func shrink(ops []*oper, spec string, periods hashPeriods, cfg *config) ([]*oper, error) {
+	ops, err := replayOnce(ops, spec, periods, cfg)
+	var mismatch *mismatchError
+	if !errors.As(err, &mismatch) {
+		return nil, fmt.Errorf("shrink: sequence does not fail with a mismatch: %v", err)
+	}
+	signature := mismatch.signature()
+	logInfo("shrink: %d operations fail with signature %s", len(ops), signature)
+	stillFails := func(candidate []*oper) ([]*oper, bool) {
+		run, err := replayOnce(candidate, spec, periods, cfg)
+		var mismatch *mismatchError
+		return run, errors.As(err, &mismatch) && mismatch.signature() == signature
+	}
+	n := 2
+	for len(ops) >= 2 {
+		chunk := (len(ops) + n - 1) / n
+		reduced := false
+		for start := 0; start < len(ops); start += chunk {
+			candidate := withoutRange(ops, start, start+chunk)
+			if len(candidate) == 0 {
+				continue
+			}
+			if run, ok := stillFails(candidate); ok {
+				logInfo("shrink: reduced from %d to %d operations", len(ops), len(run))
+				ops = run
+				if n > 2 {
+					n--
+				}
+				reduced = true
+				break
+			}
+		}
+		if !reduced {
+			if n >= len(ops) {
+				break
+			}
+			n *= 2
+			if n > len(ops) {
+				n = len(ops)
+			}
+		}
+	}
+	return ops, nil
+}
+
+func writeTrace(path string, ops []*oper) error {
+	w, err := newTraceWriter(path)
+	if err != nil {
+		return fmt.Errorf("writeTrace: %v", err)
+	}
+	for _, op := range ops {
+		if err := w.write(op); err != nil {
+			_ = w.close()
+			return fmt.Errorf("writeTrace: %v", err)
+		}
+	}
+	return w.close()
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestWithoutRangeDropsOrphans(t *testing.T) {
+	open := &oper{id: 0, code: operOpen}
+	mkdir := &oper{id: 1, code: operMkdir}
+	dup := &oper{id: 2, code: operDup, parent: open, cmd: cmdDup}
+	write := &oper{id: 3, code: operWrite, parent: dup}
+	closeOp := &oper{id: 4, code: operClose, parent: open}
+	ops := []*oper{open, mkdir, dup, write, closeOp}
+	kept := withoutRange(ops, 0, 1)
+	if len(kept) != 1 || kept[0] != mkdir {
+		t.Errorf("got %v, want only the mkdir", kept)
+	}
+	kept = withoutRange(ops, 1, 2)
+	if len(kept) != 4 {
+		t.Errorf("got %v, want all but the mkdir", kept)
+	}
+}
+
+func TestWithoutRangeDropsDup3OfRemovedReplaced(t *testing.T) {
+	open1 := &oper{id: 0, code: operOpen}
+	open2 := &oper{id: 1, code: operOpen}
+	dup3 := &oper{id: 2, code: operDup, parent: open1, cmd: cmdDup3, replaced: open2}
+	kept := withoutRange([]*oper{open1, open2, dup3}, 1, 2)
+	if len(kept) != 1 || kept[0] != open1 {
+		t.Errorf("got %v, want only the first open", kept)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The sut inode numbers of files, by pathname, before an operation that
+// must preserve them: a rename for the file renamed, or both exchanged,
+// a remount for all files known.
+type inodesBefore map[string]uint64
+
+func (op *oper) beforeInodes(seq *operSeq) inodesBefore {
+	switch op.code {
+	case operRename1, operRename2:
+		return sutInodes([]string{op.pathname})
+	case operRenameat2:
+		if op.rflags&unix.RENAME_EXCHANGE != 0 {
+			return sutInodes([]string{op.pathname, op.newpathname})
+		}
+		return sutInodes([]string{op.pathname})
+	case operMuscleRemount:
+		return sutInodes(seq.knownPaths())
+	default:
+		return nil
+	}
+}
+
+// Identifies a file on either file system.
+type fileID struct {
+	dev, ino uint64
+}
+
+// Records the files the operation has open, on both file systems, have
+// space allocated past their end, up to end, which statHolds can't
+// account for.
+func (seq *operSeq) preallocate(op *oper, end int64) {
+	if seq.preallocated == nil {
+		seq.preallocated = make(map[fileID]int64)
+	}
+	record := func(id fileID) {
+		if end > seq.preallocated[id] {
+			seq.preallocated[id] = end
+		}
+	}
+	var st unix.Stat_t
+	if err := sutClient().fstat(op.sutfd, &st); err == nil {
+		record(fileID{st.Dev, st.Ino})
+	}
+	if err := unix.Fstat(op.reffd, &st); err == nil {
+		record(fileID{st.Dev, st.Ino})
+	}
+}
+
+// Forgets the space allocated past the end of the file the operation
+// truncated, on the file systems where it succeeded, once the length
+// covers it. Shorter lengths may free only some of it, so it's kept.
+func (seq *operSeq) truncated(op *oper) {
+	forget := func(c sysClient, cwd int, fd int) {
+		var st unix.Stat_t
+		var err error
+		if op.code == operFtruncate {
+			err = c.fstat(fd, &st)
+		} else {
+			err = c.fstatat(cwd, seq.relativize(op.pathname), &st, 0)
+		}
+		id := fileID{st.Dev, st.Ino}
+		if end, ok := seq.preallocated[id]; err == nil && ok && int64(op.rbuf) >= end {
+			delete(seq.preallocated, id)
+		}
+	}
+	sutfd, reffd := -1, -1
+	if op.parent != nil {
+		sutfd, reffd = op.parent.sutfd, op.parent.reffd
+	}
+	if op.suterr == nil {
+		forget(sutClient(), seq.sutcwd, sutfd)
+	}
+	if op.referr == nil {
+		forget(kernelClient{}, seq.refcwd, reffd)
+	}
+}
+
+// The preallocated files, on the system under test and the reference,
+// whose last link an operation is about to remove, cf. beforeUnlinks.
+type unlinksBefore struct {
+	sut, ref []fileID
+}
+
+// Returns the preallocated files whose last link the operation removes
+// if it succeeds, unlinking or renaming over it, and which no file
+// descriptor keeps open, so that their inode numbers can be reused.
+func (op *oper) beforeUnlinks(seq *operSeq) unlinksBefore {
+	var pathname string
+	switch op.code {
+	case operUnlink1, operUnlink2:
+		pathname = op.pathname
+	case operRename1, operRename2:
+		pathname = op.newpathname
+	case operRenameat2:
+		if op.rflags&unix.RENAME_EXCHANGE != 0 {
+			return unlinksBefore{}
+		}
+		pathname = op.newpathname
+	default:
+		return unlinksBefore{}
+	}
+	if len(seq.preallocated) == 0 {
+		return unlinksBefore{}
+	}
+	last := func(c sysClient, cwd int, fds func(*oper) int) []fileID {
+		var st, src unix.Stat_t
+		if c.fstatat(cwd, seq.relativize(pathname), &st, unix.AT_SYMLINK_NOFOLLOW) != nil || st.Nlink != 1 {
+			return nil
+		}
+		id := fileID{st.Dev, st.Ino}
+		if _, ok := seq.preallocated[id]; !ok {
+			return nil
+		}
+		// Renaming a file onto itself removes nothing.
+		if op.code != operUnlink1 && op.code != operUnlink2 &&
+			c.fstatat(cwd, seq.relativize(op.pathname), &src, unix.AT_SYMLINK_NOFOLLOW) == nil && src.Dev == st.Dev && src.Ino == st.Ino {
+			return nil
+		}
+		for _, o := range seq.openOpers {
+			if c.fstat(fds(o), &src) == nil && src.Dev == st.Dev && src.Ino == st.Ino {
+				return nil
+			}
+		}
+		return []fileID{id}
+	}
+	return unlinksBefore{
+		sut: last(sutClient(), seq.sutcwd, func(o *oper) int { return o.sutfd }),
+		ref: last(kernelClient{}, seq.refcwd, func(o *oper) int { return o.reffd }),
+	}
+}
+
+// Forgets the preallocation of the files the operation unlinked, on the
+// file systems where it succeeded.
+func (seq *operSeq) unlinked(op *oper, before unlinksBefore) {
+	if op.suterr == nil {
+		for _, id := range before.sut {
+			delete(seq.preallocated, id)
+		}
+	}
+	if op.referr == nil {
+		for _, id := range before.ref {
+			delete(seq.preallocated, id)
+		}
+	}
+}
+
+// Returns all pathnames of files, directories and links known to exist.
+func (seq *operSeq) knownPaths() []string {
+	seq.mu.Lock()
+	defer seq.mu.Unlock()
+	var paths []string
+	for _, s := range []*pathSet{seq.existingFiles, seq.existingDirs, seq.existingLinks} {
+		paths = append(paths, s.list()...)
+	}
+	return paths
+}
+
+// Returns the inode numbers of those of the files that exist on the
+// system under test, not following links.
+func sutInodes(paths []string) inodesBefore {
+	c := sutClient()
+	root, err := c.open(filesystems[suti].mountpoint(), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		logWarn("sutInodes: %v", err)
+		return nil
+	}
+	defer func() {
+		_ = c.close(root)
+	}()
+	inodes := make(inodesBefore)
+	for _, p := range paths {
+		var st unix.Stat_t
+		if c.fstatat(root, p, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			inodes[p] = st.Ino
+		}
+	}
+	return inodes
+}
+
+// Checks the invariants of the attributes that can't be compared
+// between file systems, after the operation, on both file systems where
+// it succeeded: blocks consistent with the size, unless preallocated,
+// sane statfs counts, and inode numbers surviving renames and remounts.
+func (op *oper) checkStat(seq *operSeq, before inodesBefore) error {
+	switch op.code {
+	case operRename1, operRename2, operRenameat2, operMuscleRemount:
+		return op.checkInodes(before)
+	}
+	if op.suterr == nil {
+		var fd int
+		if op.parent != nil {
+			fd = op.parent.sutfd
+		}
+		if err := op.statHolds(seq, sutClient(), seq.sutcwd, fd, filesystems[suti].mountpoint()); err != nil {
+			return op.mismatch("stat", "%v: sut: %v", op.code, err)
+		}
+	}
+	if op.referr == nil {
+		var fd int
+		if op.parent != nil {
+			fd = op.parent.reffd
+		}
+		if err := op.statHolds(seq, kernelClient{}, seq.refcwd, fd, refDir); err != nil {
+			return op.mismatch("stat", "%v: ref: %v", op.code, err)
+		}
+	}
+	return nil
+}
+
+// Checks the invariants on one of the file systems, through the given
+// client, current working directory, file descriptor for the parent
+// operation, if any, and root.
+func (op *oper) statHolds(seq *operSeq, c sysClient, cwd int, fd int, root string) error {
+	var st unix.Stat_t
+	var err error
+	switch op.code {
+	case operStat:
+		err = c.fstatat(cwd, seq.relativize(op.pathname), &st, 0)
+	case operLstat:
+		err = c.fstatat(cwd, seq.relativize(op.pathname), &st, unix.AT_SYMLINK_NOFOLLOW)
+	case operFstat:
+		err = c.fstat(fd, &st)
+	case operStatfs:
+		var fs unix.Statfs_t
+		if err := c.statfs(filepath.Join(root, op.pathname), &fs); err != nil {
+			return err
+		}
+		return statfsHolds(&fs)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := seq.preallocated[fileID{st.Dev, st.Ino}]; st.Mode&unix.S_IFMT != unix.S_IFREG || ok {
+		return nil
+	}
+	// Blocks may be missing, for holes, but not more than the size needs,
+	// bar a couple of blocks of metadata, e.g., extended attributes or
+	// extents, which some file systems count.
+	if st.Blksize <= 0 {
+		return fmt.Errorf("block size %d", st.Blksize)
+	}
+	blksize := int64(st.Blksize)
+	if max := (st.Size+blksize-1)/blksize*blksize + 2*blksize; st.Blocks*512 > max {
+		return fmt.Errorf("%d blocks for size %d", st.Blocks, st.Size)
+	}
+	return nil
+}
+
+func statfsHolds(fs *unix.Statfs_t) error {
+	if fs.Bsize <= 0 {
+		return fmt.Errorf("block size %d", fs.Bsize)
+	}
+	if fs.Bavail > fs.Bfree || fs.Bfree > fs.Blocks {
+		return fmt.Errorf("blocks: %d available, %d free, %d total", fs.Bavail, fs.Bfree, fs.Blocks)
+	}
+	if fs.Ffree > fs.Files {
+		return fmt.Errorf("inodes: %d free, %d total", fs.Ffree, fs.Files)
+	}
+	if fs.Namelen <= 0 {
+		return fmt.Errorf("name length %d", fs.Namelen)
+	}
+	return nil
+}
+
+// Checks the files have the same inode numbers as before a rename, for
+// the file renamed, now under the new name, or for both files exchanged,
+// or a remount, for all files.
+func (op *oper) checkInodes(before inodesBefore) error {
+	if op.suterr != nil || op.referr != nil || len(before) == 0 {
+		return nil
+	}
+	if op.code != operMuscleRemount {
+		ino, ok := before[op.pathname]
+		if !ok || op.pathname == op.newpathname {
+			return nil
+		}
+		moved := inodesBefore{op.newpathname: ino}
+		if ino, ok := before[op.newpathname]; ok && op.code == operRenameat2 {
+			moved[op.pathname] = ino
+		}
+		before = moved
+	}
+	var paths []string
+	for p := range before {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	after := sutInodes(paths)
+	for _, p := range paths {
+		if ino, ok := after[p]; ok && ino != before[p] {
+			return op.mismatch("inode", "%v: %q: inode %d, was %d", op.code, p, ino, before[p])
+		}
+	}
+	return nil
+}
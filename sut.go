@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A sut is a file system under test, made available under a mount
+// point of the host file system.
+type sut interface {
+	start() error
+	stop() error
+	mount() error
+	unmount() error
+	mountpoint() string
+
+	// Releases what is held for the whole run, e.g., log files.
+	close() error
+}
+
+// What follows are optional capabilities of a sut. Operations that need
+// a capability the sut lacks are disabled, see supported.
+
+type flusher interface {
+	flush() error
+}
+
+type pusher interface {
+	push() error
+	// Waits for the last push to be complete.
+	waitForSnapshot() error
+	// Checks that nothing is left to push.
+	pushed() error
+}
+
+type puller interface {
+	pull() error
+}
+
+type remounter interface {
+	// Restarts and remounts the sut. All files must have been closed.
+	restart() error
+}
+
+// Crashes the sut: kill stops it without giving it a chance to save
+// anything, with files still open; recoverFromKill, called after the
+// files have been closed, starts and mounts it again.
+type crasher interface {
+	kill() error
+	recoverFromKill() error
+}
+
+type cachePruner interface {
+	pruneCache() error
+}
+
+// Runs commands through a control file, for operations not available
+// through system calls, like unlink2 and rename2.
+type commander interface {
+	runCommand(cmd string) ([]byte, error)
+}
+
+// Provides a client for system calls, for systems under test not
+// reachable through the kernel. Only operations the client can express
+// are run, see clientOperation.
+type clientProvider interface {
+	client() sysClient
+}
+
+// Hashes the tree of systems under test whose files are not reachable
+// through the host file system, cf. hashTree.
+type treeHasher interface {
+	hashTree(includeMeta, includeContent, includeTimes bool) ([]byte, error)
+}
+
+// Logs the 9P messages exchanged with the sut, see ninepProxy.
+type wireTracer interface {
+	// Returns the path to the log, or the empty string if not logging.
+	wireTrace() string
+}
+
+// Returns the client for system calls on the current system under test.
+func sutClient() sysClient {
+	if c, ok := filesystems[suti].(clientProvider); ok {
+		return c.client()
+	}
+	return kernelClient{}
+}
+
+func hashSUT(fs sut, includeMeta, includeContent, includeTimes bool) ([]byte, error) {
+	if h, ok := fs.(treeHasher); ok {
+		return h.hashTree(includeMeta, includeContent, includeTimes)
+	}
+	return hashTree(fs.mountpoint(), includeMeta, includeContent, includeTimes)
+}
+
+// Creates the systems under test within testDir, according to spec,
+// which is either "musclefs", "9p" (musclefs through an in-process 9P
+// client), or "dir:" followed by the path to an existing directory.
+// The second one, if not nil, is used for operSwapClients. If
+// traceWire, the 9P messages are logged, where applicable.
+func newSUTs(spec string, traceWire bool) (fss [2]sut, err error) {
+	switch {
+	case strings.HasPrefix(spec, "dir:"):
+		fs, err := newDirFS(strings.TrimPrefix(spec, "dir:"))
+		if err != nil {
+			return fss, fmt.Errorf("newSUTs: %v", err)
+		}
+		fss[0] = fs
+		return fss, nil
+	case spec == "musclefs", spec == "9p":
+		encryptionKey, err := newEncryptionKey()
+		if err != nil {
+			return fss, fmt.Errorf("newSUTs: %v", err)
+		}
+		for i := range fss {
+			fs, err := newMuscleFS(testDir, filepath.Join(testDir, fmt.Sprintf("sut%d", i)), encryptionKey, traceWire)
+			if err != nil {
+				return fss, fmt.Errorf("newSUTs: %v", err)
+			}
+			if spec == "9p" {
+				fss[i] = &ninepfs{muscle: fs}
+			} else {
+				fss[i] = fs
+			}
+		}
+		return fss, nil
+	default:
+		return fss, fmt.Errorf("newSUTs: unknown system under test %q", spec)
+	}
+}
+
+// Reports whether the systems under test have the capabilities needed
+// to run the operation.
+func supported(code operKind, fss [2]sut) bool {
+	fs := fss[0]
+	if _, ok := fs.(clientProvider); ok && !clientOperation(code) {
+		return false
+	}
+	switch code {
+	case operUnlink2, operRename2, operMuscleTrim:
+		_, ok := fs.(commander)
+		return ok
+	case operMuscleFlush:
+		_, ok := fs.(flusher)
+		return ok
+	case operMusclePush:
+		_, ok := fs.(pusher)
+		return ok
+	case operMuscleRemount:
+		_, ok := fs.(remounter)
+		return ok
+	case operMuscleCrash:
+		_, ok := fs.(crasher)
+		return ok
+	case operMusclePruneCache:
+		_, ok1 := fs.(pusher)
+		_, ok2 := fs.(cachePruner)
+		return ok1 && ok2
+	case operSwapClients:
+		if fss[1] == nil {
+			return false
+		}
+		for _, fs := range fss {
+			_, ok1 := fs.(pusher)
+			_, ok2 := fs.(puller)
+			if !ok1 || !ok2 {
+				return false
+			}
+		}
+		return true
+	default:
+		return true
+	}
+}
+
+// Reports whether the operation only needs the system calls of
+// sysClient, or capabilities, as opposed to the kernel.
+func clientOperation(code operKind) bool {
+	switch code {
+	case operCreate, operOpen, operTmpfile, operDup, operSeek, operRead, operWrite, operClose,
+		operPread, operPwrite, operReadv, operWritev, operFsync, operFdatasync,
+		operSyncfs,
+		operUnlink1, operUnlink2, operTruncate, operFtruncate, operFallocate, operMkdir,
+		operRmdir, operRename1, operRename2, operChdir, operLstat, operStat,
+		operFstat, operStatfs, operChmod,
+		operFchmod, operFchmodat, operUtimensat, operFutimens, operMuscleFlush,
+		operMusclePush, operMuscleRemount, operMusclePruneCache,
+		operMuscleTrim, operMuscleCrash, operSwapClients:
+		return true
+	default:
+		return false
+	}
+}
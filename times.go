@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allowance for the clock the kernel uses for timestamps, which is
+// coarser than the one behind time.Now, so it may lag behind it.
+const clockSlack = 20 * time.Millisecond
+
+// What checkTimes needs to know about the state before an operation.
+type timesBefore struct {
+	start time.Time
+	// The size of the file to truncate, or -1 if unknown.
+	size int64
+	// Whether both names given to a rename refer to the same file, in
+	// which case nothing is done.
+	sameFile bool
+}
+
+// Notes the state before running the operation that checkTimes needs,
+// from the reference file system.
+func (op *oper) beforeTimes(seq *operSeq) timesBefore {
+	b := timesBefore{start: time.Now(), size: -1}
+	var st unix.Stat_t
+	switch op.code {
+	case operTruncate:
+		if unix.Fstatat(seq.refcwd, seq.relativize(op.pathname), &st, 0) == nil {
+			b.size = st.Size
+		}
+	case operFtruncate:
+		if unix.Fstat(op.parent.reffd, &st) == nil {
+			b.size = st.Size
+		}
+	case operRename1, operRenameat2:
+		var newst unix.Stat_t
+		if unix.Fstatat(seq.refcwd, seq.relativize(op.pathname), &st, unix.AT_SYMLINK_NOFOLLOW) == nil &&
+			unix.Fstatat(seq.refcwd, seq.relativize(op.newpathname), &newst, unix.AT_SYMLINK_NOFOLLOW) == nil {
+			b.sameFile = st.Dev == newst.Dev && st.Ino == newst.Ino
+		}
+	}
+	return b
+}
+
+// Checks the timestamps after the operation, on both file systems
+// where it succeeded: writes and truncations that change the size
+// update the modification and change times, renames update the
+// modification time of the directories involved, and times set
+// explicitly read back the same, to the configured granularity.
+func (op *oper) checkTimes(seq *operSeq, before timesBefore) error {
+	if op.suterr == nil {
+		var fd int
+		if op.parent != nil {
+			fd = op.parent.sutfd
+		}
+		if err := op.timesHold(seq, sutClient(), seq.sutcwd, fd, before); err != nil {
+			return op.mismatch("times", "%v: sut: %v", op.code, err)
+		}
+	}
+	if op.referr == nil {
+		var fd int
+		if op.parent != nil {
+			fd = op.parent.reffd
+		}
+		if err := op.timesHold(seq, kernelClient{}, seq.refcwd, fd, before); err != nil {
+			return op.mismatch("times", "%v: ref: %v", op.code, err)
+		}
+	}
+	return nil
+}
+
+// Checks the timestamps on one of the file systems, through the given
+// client, current working directory and file descriptor for the parent
+// operation, if any.
+func (op *oper) timesHold(seq *operSeq, c sysClient, cwd int, fd int, before timesBefore) error {
+	// The earliest a timestamp updated by the operation can be.
+	earliest := before.start.Add(-clockSlack).Truncate(timeGranularity)
+	var st unix.Stat_t
+	switch op.code {
+	case operWrite, operPwrite, operWritev:
+		if op.refn == 0 {
+			return nil
+		}
+		if err := c.fstat(fd, &st); err != nil {
+			return err
+		}
+		return updated(&st, earliest)
+	case operTruncate, operFtruncate:
+		if before.size == -1 || before.size == int64(op.rbuf) {
+			return nil
+		}
+		var err error
+		if op.code == operTruncate {
+			err = c.fstatat(cwd, seq.relativize(op.pathname), &st, 0)
+		} else {
+			err = c.fstat(fd, &st)
+		}
+		if err != nil {
+			return err
+		}
+		return updated(&st, earliest)
+	case operRename1, operRenameat2:
+		if op.pathname == op.newpathname || before.sameFile {
+			return nil
+		}
+		// The cwd moved, so paths relative to it don't lead to the same
+		// directories any more.
+		if isUnder(seq.cwdpath, op.pathname) || isUnder(seq.cwdpath, op.newpathname) {
+			return nil
+		}
+		for _, dir := range []string{filepath.Dir(op.pathname), filepath.Dir(op.newpathname)} {
+			if err := c.fstatat(cwd, seq.relativize(dir), &st, 0); err != nil {
+				return err
+			}
+			if mtime := timespecTime(st.Mtim); mtime.Before(earliest) {
+				return fmt.Errorf("directory %q: mtime %v before %v", dir, mtime, earliest)
+			}
+		}
+		return nil
+	case operUtimensat, operFutimens:
+		if op.times[0].Nsec == unix.UTIME_OMIT && op.times[1].Nsec == unix.UTIME_OMIT {
+			// Succeeds early, even if there's no such file.
+			return nil
+		}
+		var err error
+		if op.code == operUtimensat {
+			err = c.fstatat(cwd, seq.relativize(op.pathname), &st, op.atflags)
+		} else {
+			err = c.fstat(fd, &st)
+		}
+		if err != nil {
+			return err
+		}
+		got := []unix.Timespec{st.Atim, st.Mtim}
+		for i, name := range []string{"atime", "mtime"} {
+			t := timespecTime(got[i])
+			switch op.times[i].Nsec {
+			case unix.UTIME_OMIT:
+			case unix.UTIME_NOW:
+				if t.Before(earliest) {
+					return fmt.Errorf("%s %v before %v", name, t, earliest)
+				}
+			default:
+				want := timespecTime(op.times[i])
+				if !t.Truncate(timeGranularity).Equal(want.Truncate(timeGranularity)) {
+					return fmt.Errorf("%s %v, want %v", name, t, want)
+				}
+			}
+		}
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Checks the modification and change times are not before earliest.
+func updated(st *unix.Stat_t, earliest time.Time) error {
+	if mtime := timespecTime(st.Mtim); mtime.Before(earliest) {
+		return fmt.Errorf("mtime %v before %v", mtime, earliest)
+	}
+	if ctime := timespecTime(st.Ctim); ctime.Before(earliest) {
+		return fmt.Errorf("ctime %v before %v", ctime, earliest)
+	}
+	return nil
+}
+
+func timespecTime(ts unix.Timespec) time.Time {
+	return time.Unix(ts.Sec, ts.Nsec)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A traceRecord is the serialized form of an operation, inputs and
+// outputs, as stored in a trace file, one JSON object per line.
+type traceRecord struct {
+	ID          int             `json:"id"`
+	Code        string          `json:"code"`
+	Parent      *int            `json:"parent,omitempty"`
+	Pathname    string          `json:"pathname,omitempty"`
+	Newpathname string          `json:"newpathname,omitempty"`
+	Target      string          `json:"target,omitempty"`
+	Flags       openFlags       `json:"flags,omitempty"`
+	Mode        uint32          `json:"mode,omitempty"`
+	Times       []unix.Timespec `json:"times,omitempty"`
+	AtFlags     int             `json:"atflags,omitempty"`
+	Xattr       string          `json:"xattr,omitempty"`
+	XFlags      int             `json:"xflags,omitempty"`
+	RFlags      uint            `json:"rflags,omitempty"`
+	MsFlags     int             `json:"msflags,omitempty"`
+	Cmd         int             `json:"cmd,omitempty"`
+	Replaced    *int            `json:"replaced,omitempty"`
+	Rbuf        int             `json:"rbuf,omitempty"`
+	Wbuf        []byte          `json:"wbuf,omitempty"`
+	Iov         []int           `json:"iov,omitempty"`
+	Offset      int64           `json:"offset,omitempty"`
+	Length      int             `json:"length,omitempty"`
+	Whence      int             `json:"whence,omitempty"`
+
+	SutN    int    `json:"sutn,omitempty"`
+	RefN    int    `json:"refn,omitempty"`
+	SutBuf  []byte `json:"sutbuf,omitempty"`
+	RefBuf  []byte `json:"refbuf,omitempty"`
+	SutFd   int    `json:"sutfd,omitempty"`
+	RefFd   int    `json:"reffd,omitempty"`
+	SutOff  int64  `json:"sutoff,omitempty"`
+	RefOff  int64  `json:"refoff,omitempty"`
+	SutStat string `json:"sutstat,omitempty"`
+	RefStat string `json:"refstat,omitempty"`
+	SutErr  string `json:"suterr,omitempty"`
+	RefErr  string `json:"referr,omitempty"`
+
+	Reopened []int `json:"reopened,omitempty"`
+}
+
+func (op *oper) record() *traceRecord {
+	r := &traceRecord{
+		ID:          op.id,
+		Code:        op.code.String(),
+		Pathname:    op.pathname,
+		Newpathname: op.newpathname,
+		Target:      op.target,
+		Flags:       op.flags,
+		Mode:        op.mode,
+		Times:       op.times,
+		AtFlags:     op.atflags,
+		Xattr:       op.xattr,
+		XFlags:      op.xflags,
+		RFlags:      op.rflags,
+		MsFlags:     op.msflags,
+		Cmd:         op.cmd,
+		Rbuf:        op.rbuf,
+		Wbuf:        op.wbuf,
+		Iov:         op.iov,
+		Offset:      op.offset,
+		Length:      op.length,
+		Whence:      op.whence,
+		SutN:        op.sutn,
+		RefN:        op.refn,
+		SutBuf:      op.sutbuf,
+		RefBuf:      op.refbuf,
+		SutFd:       op.sutfd,
+		RefFd:       op.reffd,
+		SutOff:      op.sutoff,
+		RefOff:      op.refoff,
+		SutStat:     op.sutstat,
+		RefStat:     op.refstat,
+	}
+	if op.parent != nil {
+		id := op.parent.id
+		r.Parent = &id
+	}
+	if op.replaced != nil {
+		id := op.replaced.id
+		r.Replaced = &id
+	}
+	for _, o := range op.reopened {
+		r.Reopened = append(r.Reopened, o.id)
+	}
+	if op.suterr != nil {
+		r.SutErr = op.suterr.Error()
+	}
+	if op.referr != nil {
+		r.RefErr = op.referr.Error()
+	}
+	return r
+}
+
+// Converts the record back to an operation, outputs included. The
+// byID map must contain all previously converted operations, so that
+// the parent can be linked.
+func (r *traceRecord) oper(byID map[int]*oper) (*oper, error) {
+	code, err := lookupOperKind(r.Code)
+	if err != nil {
+		return nil, fmt.Errorf("traceRecord.oper: op %d: %v", r.ID, err)
+	}
+	op := &oper{
+		id:          r.ID,
+		code:        code,
+		pathname:    r.Pathname,
+		newpathname: r.Newpathname,
+		target:      r.Target,
+		flags:       r.Flags,
+		mode:        r.Mode,
+		times:       r.Times,
+		atflags:     r.AtFlags,
+		xattr:       r.Xattr,
+		xflags:      r.XFlags,
+		rflags:      r.RFlags,
+		msflags:     r.MsFlags,
+		cmd:         r.Cmd,
+		rbuf:        r.Rbuf,
+		wbuf:        r.Wbuf,
+		iov:         r.Iov,
+		offset:      r.Offset,
+		length:      r.Length,
+		whence:      r.Whence,
+		sutn:        r.SutN,
+		refn:        r.RefN,
+		sutbuf:      r.SutBuf,
+		refbuf:      r.RefBuf,
+		sutfd:       r.SutFd,
+		reffd:       r.RefFd,
+		sutoff:      r.SutOff,
+		refoff:      r.RefOff,
+		sutstat:     r.SutStat,
+		refstat:     r.RefStat,
+		suterr:      errorFromString(r.SutErr),
+		referr:      errorFromString(r.RefErr),
+	}
+	if r.Parent != nil {
+		parent, ok := byID[*r.Parent]
+		if !ok {
+			return nil, fmt.Errorf("traceRecord.oper: op %d: parent %d not found", r.ID, *r.Parent)
+		}
+		op.parent = parent
+	}
+	if r.Replaced != nil {
+		replaced, ok := byID[*r.Replaced]
+		if !ok {
+			return nil, fmt.Errorf("traceRecord.oper: op %d: replaced %d not found", r.ID, *r.Replaced)
+		}
+		op.replaced = replaced
+	}
+	for _, id := range r.Reopened {
+		reopened, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("traceRecord.oper: op %d: reopened %d not found", r.ID, id)
+		}
+		op.reopened = append(op.reopened, reopened)
+	}
+	return op, nil
+}
+
+// Maps error strings back to errno values where possible, so that
+// errors read from a trace compare equal to fresh ones.
+func errorFromString(s string) error {
+	if s == "" {
+		return nil
+	}
+	for e := syscall.Errno(1); e < 256; e++ {
+		if e.Error() == s {
+			return e
+		}
+	}
+	return errors.New(s)
+}
+
+type traceWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newTraceWriter(path string) (*traceWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("newTraceWriter: %v", err)
+	}
+	return &traceWriter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (w *traceWriter) write(op *oper) error {
+	if err := w.enc.Encode(op.record()); err != nil {
+		return fmt.Errorf("traceWriter.write: %v", err)
+	}
+	return nil
+}
+
+func (w *traceWriter) close() error {
+	return w.f.Close()
+}
+
+func readTrace(r io.Reader) ([]*oper, error) {
+	var ops []*oper
+	byID := make(map[int]*oper)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16*1024*1024)
+	for s.Scan() {
+		var rec traceRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("readTrace: line %d: %v", len(ops)+1, err)
+		}
+		op, err := rec.oper(byID)
+		if err != nil {
+			return nil, fmt.Errorf("readTrace: line %d: %v", len(ops)+1, err)
+		}
+		byID[op.id] = op
+		ops = append(ops, op)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("readTrace: %v", err)
+	}
+	return ops, nil
+}
+
+func loadTrace(path string) ([]*oper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadTrace: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return readTrace(f)
+}
+
+// Copies the operations, inputs only, preserving the links to parent
+// and replaced operations within the copied sequence. Used to replay a
+// recorded sequence.
+func cloneOpers(ops []*oper) []*oper {
+	clones := make([]*oper, 0, len(ops))
+	byID := make(map[int]*oper)
+	for _, op := range ops {
+		c := &oper{
+			id:          op.id,
+			code:        op.code,
+			pathname:    op.pathname,
+			newpathname: op.newpathname,
+			target:      op.target,
+			flags:       op.flags,
+			mode:        op.mode,
+			times:       op.times,
+			atflags:     op.atflags,
+			xattr:       op.xattr,
+			xflags:      op.xflags,
+			rflags:      op.rflags,
+			msflags:     op.msflags,
+			cmd:         op.cmd,
+			rbuf:        op.rbuf,
+			wbuf:        op.wbuf,
+			iov:         op.iov,
+			offset:      op.offset,
+			length:      op.length,
+			whence:      op.whence,
+		}
+		if op.parent != nil {
+			c.parent = byID[op.parent.id]
+		}
+		if op.replaced != nil {
+			c.replaced = byID[op.replaced.id]
+		}
+		byID[c.id] = c
+		clones = append(clones, c)
+	}
+	return clones
+}
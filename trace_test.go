@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestTraceRoundTrip(t *testing.T) {
+	open := &oper{id: 0, code: operOpen, pathname: "alfa/bravo", flags: syscall.O_RDWR, mode: 0777, sutfd: 7, reffd: 8}
+	write := &oper{id: 1, code: operWrite, parent: open, wbuf: []byte("hello"), sutn: 5, refn: 5}
+	read := &oper{id: 2, code: operRead, parent: open, rbuf: 3, suterr: syscall.EBADF, referr: syscall.EBADF}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, op := range []*oper{open, write, read} {
+		if err := enc.Encode(op.record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ops, err := readTrace(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(ops); got != 3 {
+		t.Fatalf("got %d opers, want 3", got)
+	}
+	if ops[1].parent != ops[0] || ops[2].parent != ops[0] {
+		t.Errorf("parent links not restored")
+	}
+	if got, want := ops[0].String(), open.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := ops[1].String(), write.String(); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if ops[2].referr != syscall.EBADF {
+		t.Errorf("got error %#v, want %#v", ops[2].referr, syscall.EBADF)
+	}
+}
+
+func TestReadTraceRejectsUnknownOperations(t *testing.T) {
+	trace := `{"id": 0, "code": "open", "pathname": "alfa"}
+{"id": 1, "code": "frobnicate"}
+`
+	if _, err := readTrace(strings.NewReader(trace)); err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), `unknown operation "frobnicate"`) {
+		t.Errorf("got %v, want an unknown operation error on line 2", err)
+	}
+}
@@ -3,29 +3,86 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-func hashTree(path string, includeMeta, includeContent bool) ([]byte, error) {
+func hashTree(path string, includeMeta, includeContent, includeTimes bool) ([]byte, error) {
 	var b bytes.Buffer
-	if err := hashAny(&b, path, "", includeMeta, includeContent); err != nil {
+	if err := hashAny(&b, path, "", includeMeta, includeContent, includeTimes, make(map[uint64]string)); err != nil {
 		return nil, err
 	}
 	return b.Bytes(), nil
 }
 
-func hashAny(buf *bytes.Buffer, base, rel string, includeMeta, includeContent bool) error {
-	f, err := os.Stat(filepath.Join(base, rel))
+// Splits the description of a tree, as returned by hashTree, into the
+// lines about each path.
+func describedPaths(desc []byte) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, line := range strings.SplitAfter(string(desc), "\n") {
+		if line == "" {
+			continue
+		}
+		quoted := strings.TrimPrefix(line, "path=")
+		end := 1
+		for end < len(quoted) && quoted[end] != '"' {
+			if quoted[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(quoted) {
+			return nil, fmt.Errorf("describedPaths: bad line %q", line)
+		}
+		path, err := strconv.Unquote(quoted[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("describedPaths: bad line %q: %v", line, err)
+		}
+		paths[path] += line
+	}
+	return paths, nil
+}
+
+// The firsts map holds the first path found for each inode with multiple
+// links, so that other links to it can be described as such.
+func hashAny(buf *bytes.Buffer, base, rel string, includeMeta, includeContent, includeTimes bool, firsts map[uint64]string) error {
+	// Not following symbolic links, which may dangle or loop.
+	f, err := os.Lstat(filepath.Join(base, rel))
 	if err != nil {
 		return fmt.Errorf("hashAny: %v", err)
 	}
-	if f.IsDir() {
+	if f.Mode()&os.ModeSymlink != 0 {
+		if includeMeta {
+			target, err := os.Readlink(filepath.Join(base, rel))
+			if err != nil {
+				return fmt.Errorf("hashAny: %w", err)
+			}
+			_, _ = fmt.Fprintf(buf, "path=%q mode=0%o target=%q%s\n", rel, f.Mode(), target, describeLinks(f, rel, firsts))
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, describeTime(f.ModTime()))
+		}
+	} else if f.IsDir() {
 		if includeMeta {
 			_, _ = fmt.Fprintf(buf, "path=%q mode=0%o\n", rel, f.Mode())
+			if err := describeXattrs(buf, filepath.Join(base, rel), rel); err != nil {
+				return err
+			}
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, describeTime(f.ModTime()))
 		}
 		children, err := os.ReadDir(filepath.Join(base, rel))
 		if err != nil {
@@ -35,21 +92,241 @@ func hashAny(buf *bytes.Buffer, base, rel string, includeMeta, includeContent bo
 			return children[i].Name() < children[j].Name()
 		})
 		for _, child := range children {
-			if err := hashAny(buf, base, filepath.Join(rel, child.Name()), includeMeta, includeContent); err != nil {
+			if err := hashAny(buf, base, filepath.Join(rel, child.Name()), includeMeta, includeContent, includeTimes, firsts); err != nil {
 				return err
 			}
 		}
 	} else {
 		if includeMeta {
-			_, _ = fmt.Fprintf(buf, "path=%q size=%d mode=0%o\n", rel, f.Size(), f.Mode())
+			_, _ = fmt.Fprintf(buf, "path=%q size=%d mode=0%o%s\n", rel, f.Size(), f.Mode(), describeLinks(f, rel, firsts))
+			if err := describeXattrs(buf, filepath.Join(base, rel), rel); err != nil {
+				return err
+			}
+		}
+		if includeTimes {
+			_, _ = fmt.Fprintf(buf, "path=%q mtime=%s\n", rel, describeTime(f.ModTime()))
 		}
 		if includeContent {
-			b, err := ioutil.ReadFile(filepath.Join(base, rel))
+			sum, err := hashContent(filepath.Join(base, rel))
 			if err != nil {
 				return fmt.Errorf("hashAny: %w", err)
 			}
-			_, _ = fmt.Fprintf(buf, "path=%q hash=%x\n", rel, sha256.Sum256(b))
+			_, _ = fmt.Fprintf(buf, "path=%q hash=%x\n", rel, sum)
 		}
 	}
 	return nil
 }
+
+// Whence values for lseek(2), to find data and holes in sparse files.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Hashes the contents of the file, skipping holes where the file system
+// can tell where they are, cf. contentHasher.
+func hashContent(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return hashContentFd(kernelClient{}, int(f.Fd()))
+}
+
+// Like hashContent, for a file open through c.
+func hashContentFd(c sysClient, fd int) ([]byte, error) {
+	h := newContentHasher()
+	err := readData(c, fd, func(p []byte, offset int64) error {
+		h.writeAt(p, offset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.sum(), nil
+}
+
+// Passes the data of the file open through c to f, in increasing order
+// of offset, skipping holes where the file system can tell where they
+// are.
+func readData(c sysClient, fd int, f func(p []byte, offset int64) error) error {
+	b := make([]byte, 64<<10)
+	var offset int64
+	for {
+		data, err := c.seek(fd, offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := c.seek(fd, data, seekHole)
+		if err != nil {
+			return err
+		}
+		if hole <= data {
+			// No idea where data ends, e.g., for devices.
+			hole = math.MaxInt64
+		}
+		for offset = data; offset < hole; {
+			size := int64(len(b))
+			if hole-offset < size {
+				size = hole - offset
+			}
+			n, err := c.pread(fd, b[:size], offset)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return nil
+			}
+			if err := f(b[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+	}
+}
+
+// The unit of contents for contentHasher.
+const contentChunk = 4096
+
+// A contentHasher hashes the contents of a file, given in increasing
+// order of offset, chunk by chunk, skipping chunks of zeros. So the sum
+// is the same whether holes are read as zeros or skipped altogether,
+// and sparse files are cheap to hash. Trailing zeros don't count, the
+// size is compared along with the other metadata.
+type contentHasher struct {
+	h hash.Hash
+	// The chunk being filled, and its offset.
+	chunk  []byte
+	offset int64
+}
+
+func newContentHasher() *contentHasher {
+	return &contentHasher{h: sha256.New(), chunk: make([]byte, contentChunk)}
+}
+
+// Adds the bytes at the offset, which can't be before that of earlier
+// calls. Bytes in between are taken to be zeros.
+func (c *contentHasher) writeAt(p []byte, offset int64) {
+	for len(p) > 0 {
+		if offset >= c.offset+contentChunk {
+			c.flush()
+			c.offset = offset - offset%contentChunk
+		}
+		n := copy(c.chunk[offset-c.offset:], p)
+		p = p[n:]
+		offset += int64(n)
+	}
+}
+
+func (c *contentHasher) flush() {
+	for _, b := range c.chunk {
+		if b != 0 {
+			_ = binary.Write(c.h, binary.BigEndian, c.offset)
+			_, _ = c.h.Write(c.chunk)
+			break
+		}
+	}
+	for i := range c.chunk {
+		c.chunk[i] = 0
+	}
+	c.offset += contentChunk
+}
+
+func (c *contentHasher) sum() []byte {
+	c.flush()
+	return c.h.Sum(nil)
+}
+
+// Describes the hard links of a file other than a directory, if it has
+// more than one: how many, and the first path found for the same file.
+func describeLinks(f os.FileInfo, rel string, firsts map[uint64]string) string {
+	st, ok := f.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink <= 1 {
+		return ""
+	}
+	first, ok := firsts[st.Ino]
+	if !ok {
+		firsts[st.Ino] = rel
+		return fmt.Sprintf(" nlink=%d", st.Nlink)
+	}
+	return fmt.Sprintf(" nlink=%d same=%q", st.Nlink, first)
+}
+
+// Describes the extended attributes in the user namespace of the file
+// at path, in order of name, if hashXattrs. Those in other namespaces,
+// e.g., security labels, depend on the host.
+func describeXattrs(buf *bytes.Buffer, path, rel string) error {
+	if !hashXattrs {
+		return nil
+	}
+	names, err := userXattrs(path)
+	if err != nil {
+		return fmt.Errorf("describeXattrs: %v", err)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if err != nil {
+			return fmt.Errorf("describeXattrs: %v", err)
+		}
+		_, _ = fmt.Fprintf(buf, "path=%q xattr=%q value=%x\n", rel, name, value)
+	}
+	return nil
+}
+
+// Lists the names of the extended attributes in the user namespace of
+// the file, not following symbolic links. There are none on file
+// systems that don't support them.
+func userXattrs(path string) ([]string, error) {
+	n, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	list := make([]byte, n)
+	if n, err = unix.Llistxattr(path, list); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range xattrNames(list[:n]) {
+		if strings.HasPrefix(name, "user.") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Returns the value of an extended attribute, not following symbolic
+// links.
+func getXattr(path, name string) ([]byte, error) {
+	n, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	value := make([]byte, n)
+	n, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:n], nil
+}
+
+// Describes a timestamp, exactly, truncated to the configured
+// granularity, if it was set explicitly, which is only ever to a time
+// before the run, else as recent, as exact times can't match between the
+// file systems. Access times aren't described, as they depend on mount
+// options like relatime.
+func describeTime(t time.Time) string {
+	if !t.Before(runStart.Truncate(timeGranularity)) {
+		return "recent"
+	}
+	return t.Truncate(timeGranularity).UTC().Format(time.RFC3339Nano)
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/rogpeppe/go-internal/testscript"
 )
 
 func testscriptMain() int {
-	hash, err := hashTree(os.Args[1], true, true)
+	hash, err := hashTree(os.Args[1], true, true, false)
 	if err != nil {
 		log.Print(err)
 		return 1
@@ -25,6 +28,102 @@ func TestHashTree(t *testing.T) {
 	})
 }
 
+// Holes hash the same as zeros, but data in them doesn't.
+func TestHashContentHoles(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("hello")
+	const offset = 1<<20 + 3*contentChunk + 100
+	sparse := filepath.Join(dir, "sparse")
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dense := filepath.Join(dir, "dense")
+	if err := ioutil.WriteFile(dense, append(make([]byte, offset), data...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hash := func(path string) []byte {
+		sum, err := hashContent(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	if got, want := hash(sparse), hash(dense); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	f, err = os.OpenFile(sparse, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, contentChunk+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, other := hash(sparse), hash(dense); bytes.Equal(got, other) {
+		t.Errorf("got %x for different contents", got)
+	}
+}
+
+// Copies, as for crashes, keep hard links, which tree hashes describe.
+func TestCopyTreeHardLinks(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "f"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "f"), filepath.Join(src, "d", "g")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	want, err := hashTree(src, true, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := hashTree(dst, true, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestDescribedPaths(t *testing.T) {
+	dir := t.TempDir()
+	name := `a "quoted"\name`
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := hashTree(dir, true, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := describedPaths(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("got %q, want the root and %q", paths, name)
+	}
+	if got := paths[name]; got == "" || paths[""]+got != string(desc) {
+		t.Errorf("got %q for %q, from %q", got, name, desc)
+	}
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(m, map[string]func() int{
 		"hash": testscriptMain,